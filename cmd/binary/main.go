@@ -6,12 +6,14 @@ import (
 	"log"
 	"net"
 	"os"
+	"single-executor/internal/watchdog"
 	"time"
 )
 
 var instanceId uuid.UUID
 var nodeId string
 var duration time.Duration
+var fencingToken watchdog.FencingToken
 
 func main() {
 	nodeId = os.Getenv("NODE_ID")
@@ -26,6 +28,15 @@ func main() {
 		log.Fatalln("Must specify env CHAIN_UDP_ADDR")
 	}
 
+	// Provided by the watchdog so that the chain can reject our signatures
+	// once a newer leader has taken over.
+	var err error
+	fencingToken, err = watchdog.ParseFencingToken(os.Getenv(watchdog.EnvFencingToken))
+
+	if err != nil {
+		log.Fatalf("Invalid env %s: %s\n", watchdog.EnvFencingToken, err.Error())
+	}
+
 	id, err := uuid.NewUUID()
 
 	if err != nil {
@@ -34,7 +45,7 @@ func main() {
 
 	instanceId = id
 
-	log.Printf("Running binary. Instance ID: %s", instanceId.String())
+	log.Printf("Running binary. Instance ID: %s, fencing token: %s", instanceId.String(), fencingToken)
 
 	duration, err = time.ParseDuration(os.Getenv("SIGN_INTERVAL"))
 
@@ -81,7 +92,7 @@ func doThing(conn *net.UDPConn) {
 		panic(err)
 	}
 
-	n, err := fmt.Fprintf(conn, "%s.%s.%s", nodeId, instanceId, signature)
+	n, err := fmt.Fprintf(conn, "%s.%s.%s.%s", nodeId, instanceId, signature, fencingToken)
 
 	if err != nil {
 		log.Printf("Could not write to UDP: %s", err.Error())
@@ -2,12 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/google/uuid"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"single-executor/internal/util"
+	"single-executor/internal/watchdog"
 	"strconv"
 	"strings"
 	"time"
@@ -18,12 +20,15 @@ type Signature struct {
 	NodeId     string    `json:"nodeId"`
 	Signature  uuid.UUID `json:"signatureId"`
 	Datetime   time.Time `json:"signedAt"`
+	FencingToken string  `json:"fencingToken"`
 }
 
 type signatureStorage struct {
 	signatures []Signature
 	size int
 	listeners []chan Signature
+	// The token of the newest leadership we have accepted a signature from.
+	latestToken watchdog.FencingToken
 }
 
 func newStorage(size int) *signatureStorage {
@@ -56,6 +61,19 @@ func (s *signatureStorage) store(signature Signature) {
 	}
 }
 
+// Records that a signature was made under the given token, returning an error
+// if that leadership has since been superseded. This is how the chain protects
+// itself from a deposed leader that is still running.
+func (s *signatureStorage) fence(token watchdog.FencingToken) error {
+	if token.IsStale(s.latestToken) {
+		return fmt.Errorf("stale fencing token %s, latest is %s", token, s.latestToken)
+	}
+
+	s.latestToken = token
+
+	return nil
+}
+
 func (s *signatureStorage) list() []Signature {
 	return s.signatures
 }
@@ -135,7 +153,7 @@ func main() {
 
 		log.Printf("Received packet from %s (length: %d): %s", addr.String(), n, buffer[:n])
 
-		if len(parts) != 3 {
+		if len(parts) != 4 {
 			log.Printf("Malformed UDP packet")
 			continue
 		}
@@ -161,7 +179,19 @@ func main() {
 			continue
 		}
 
-		storage.store(Signature{instanceId, nodeId, sig, time.Now()})
+		token, err := watchdog.ParseFencingToken(parts[3])
+
+		if err != nil {
+			log.Printf("Invalid fencing token: %s", err)
+			continue
+		}
+
+		if err := storage.fence(token); err != nil {
+			log.Printf("Rejecting signature from node %s: %s", nodeId, err)
+			continue
+		}
+
+		storage.store(Signature{instanceId, nodeId, sig, time.Now(), token.String()})
 	}
 }
 
@@ -183,7 +213,10 @@ func (handler *httpHandler) ServeHTTP(writer http.ResponseWriter, request *http.
 			return
 		}
 
-		messages <- data	// Send it to the SSE.
+		select {
+		case messages <- data:	// Send it to the SSE.
+		case <- done:
+		}
 	}
 
 	go func() {
@@ -176,7 +176,11 @@ func nodeState(w http.ResponseWriter, request *http.Request) {
 					data, err = ioutil.ReadAll(response.Body)
 				}
 
-				messages <- data
+				select {
+				case messages <- data:
+				case <-done:
+					return
+				}
 
 				time.Sleep(500 * time.Millisecond)
 			}
@@ -0,0 +1,173 @@
+// simulate runs a cluster of watchdogs in one process, on a virtual clock and over a
+// simulated network, for many seeds. Each seed also decides when the network is
+// partitioned & healed. Any seed that breaks an invariant is reported, and can be
+// replayed exactly with -seed, and -trace to see every step.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"single-executor/internal/watchdog"
+	"time"
+)
+
+const defaultConfig = `
+minElectionTimeout: 3000
+maxElectionTimeout: 5000
+networkInterval: 10000
+heartbeatInterval: 1000
+listenOn: "127.0.0.1:6000"
+`
+
+func main() {
+	configFile := flag.String("f", "", "The watchdog config YAML file. Defaults to the demo's timings")
+	clusterFile := flag.String("c", "", "The watchdog cluster YAML file. Defaults to -nodes voters")
+	nodes := flag.Int("nodes", 5, "How many nodes to simulate, without a cluster file")
+	seeds := flag.Int("seeds", 100, "How many seeds to run, from 1")
+	seed := flag.Int64("seed", 0, "Run just this seed")
+	duration := flag.Duration("duration", 10*time.Minute, "How much virtual time to simulate for each seed")
+	minDelay := flag.Duration("min-delay", time.Millisecond, "The least time a message takes to arrive")
+	maxDelay := flag.Duration("max-delay", 50*time.Millisecond, "The most time a message takes to arrive")
+	loss := flag.Float64("loss", 0.01, "The chance each message is lost")
+	reorder := flag.Bool("reorder", true, "Whether messages may overtake each other")
+	faults := flag.Duration("faults", 30*time.Second, "How often the network may be partitioned or healed. 0 for never")
+	trace := flag.Bool("trace", false, "Print every step of each seed run")
+	flag.Parse()
+
+	config, err := loadConfig(*configFile)
+
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", err.Error())
+	}
+
+	cluster, err := loadCluster(*clusterFile, *nodes)
+
+	if err != nil {
+		log.Fatalf("Invalid cluster: %s", err.Error())
+	}
+
+	first, last := int64(1), int64(*seeds)
+
+	if *seed != 0 {
+		first, last = *seed, *seed
+	}
+
+	failed := 0
+
+	for s := first; s <= last; s++ {
+		simulation := watchdog.NewSimulation(watchdog.SimulationConfig{
+			Seed:          s,
+			Configuration: config,
+			Cluster:       cluster,
+			Network:       watchdog.NetworkConditions{MinDelay: *minDelay, MaxDelay: *maxDelay, Loss: *loss, Reorder: *reorder},
+		})
+
+		scheduleFaults(simulation, s, cluster, *duration, *faults)
+
+		err := simulation.Start()
+
+		if err == nil {
+			err = simulation.RunFor(*duration)
+		}
+
+		summary := describe(simulation)
+		simulation.Shutdown()
+
+		if *trace {
+			for _, step := range simulation.Trace() {
+				fmt.Println(step)
+			}
+		}
+
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s\n", err.Error())
+		} else {
+			fmt.Printf("ok   seed %d: %s\n", s, summary)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d seeds failed\n", failed, last-first+1)
+		os.Exit(1)
+	}
+}
+
+// Partitions the network at random, from the seed, and heals it again.
+func scheduleFaults(simulation *watchdog.Simulation, seed int64, cluster watchdog.Cluster, duration time.Duration, every time.Duration) {
+	if every == 0 {
+		return
+	}
+
+	random := rand.New(rand.NewSource(seed))
+	nodes := cluster.Nodes()
+
+	for at := every; at < duration; at += every {
+		if random.Intn(2) == 0 {
+			simulation.At(at, "", simulation.Heal)
+			continue
+		}
+
+		// Split the nodes into two groups at random.
+		var a, b []watchdog.Id
+
+		for _, node := range nodes {
+			if random.Intn(2) == 0 {
+				a = append(a, node.Id())
+			} else {
+				b = append(b, node.Id())
+			}
+		}
+
+		simulation.At(at, "", func() {
+			simulation.Partition(a, b)
+		})
+	}
+}
+
+func describe(simulation *watchdog.Simulation) string {
+	description := ""
+
+	for _, node := range simulation.Nodes() {
+		description += fmt.Sprintf("%d:%s(t%d) ", node.Id, node.State, node.Term)
+	}
+
+	return description
+}
+
+func loadConfig(file string) (watchdog.Configuration, error) {
+	raw := []byte(defaultConfig)
+
+	if file != "" {
+		var err error
+
+		if raw, err = os.ReadFile(file); err != nil {
+			return watchdog.Configuration{}, err
+		}
+	}
+
+	return watchdog.ParseEmbeddedConfiguration(raw)
+}
+
+func loadCluster(file string, nodes int) (watchdog.Cluster, error) {
+	var raw []byte
+
+	if file != "" {
+		var err error
+
+		if raw, err = os.ReadFile(file); err != nil {
+			return watchdog.Cluster{}, err
+		}
+	} else {
+		raw = []byte("nodes:\n")
+
+		for id := 1; id <= nodes; id++ {
+			raw = append(raw, fmt.Sprintf("  - {id: %d, udpAddr: \"node%d:6000\", httpAddr: \"http://node%d\"}\n", id, id, id)...)
+		}
+	}
+
+	return watchdog.ParseCluster(raw)
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"single-executor/internal/util"
 	"single-executor/internal/watchdog"
 	"strconv"
+	"syscall"
 )
 
 func main() {
+	// We may have been started to set up a command's umask & resource limits, rather than to watch.
+	watchdog.RunExecShim()
+
 	err, config, cluster := loadConfig()
 
 	if err != nil {
@@ -23,40 +29,54 @@ func main() {
 
 	nodeIdEnv := util.MustGetEnv("NODE_ID")
 
-	nodeId, err := strconv.Atoi(nodeIdEnv)
+	nodeId, err := strconv.ParseUint(nodeIdEnv, 10, 16)
 
 	if err != nil {
 		log.Fatalf("Must specify numeric watchdog NODE_ID")
 	}
 
-	w := watchdog.NewWatchdog(watchdog.Id(nodeId), config, cluster)
+	h := watchdog.NewHost(watchdog.Id(nodeId), config, cluster)
 
-	log.Printf("Starting debug HTTP server...\n")
+	log.Printf("Starting watchdog...\n")
+
+	// Stopping (e.g. docker-compose stop) shuts the watchdog down cleanly: the process is
+	// stopped and, if leading, followers are told to elect a new leader straight away.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-	// Start an HTTP interface for debugging.
 	go func() {
-		if err := watchdog.HttpMonitor(w); err != nil {
-			log.Fatalln(err)
-		}
+		// A second signal kills us straight away, as usual.
+		<-ctx.Done()
+		stop()
 	}()
 
-	log.Printf("Starting watchdog...\n")
-
-	err = w.Start()
+	err = h.Start(ctx)
 
 	if err != nil {
 		log.Fatalf("Could not start watchdog: %s\n", err.Error())
 	}
 
+	log.Printf("Starting debug HTTP server...\n")
+
+	// Start an HTTP interface for debugging, once there's an election to report on.
+	go func() {
+		if err := watchdog.HttpMonitor(h); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
 	log.Printf("Watchdog running...\n")
 
 	for {
 		// Simply loops on output channels and report details.
 		select {
-		case err := <- w.Errors:
+		case err := <- h.Errors:
 			log.Printf("Watchdog ERR: %s\n", err.Error())
-		case info := <- w.Info:
+		case info := <- h.Info:
 			log.Printf("Watchdog INFO %s\n", info)
+		case <- h.Done():
+			log.Printf("Watchdog stopped\n")
+			return
 		}
 	}
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"single-executor/internal/watchdog"
+	"time"
+)
+
+// Generates certificates for the tls transport: a CA (unless dir already has one), and a
+// certificate for each node in the cluster file, for its identity, signed by the CA.
+// Good for testing & small clusters; otherwise, issue them from your own CA.
+func certs(args []string) error {
+	flags := flag.NewFlagSet("certs", flag.ExitOnError)
+	clusterFile := flags.String("c", "", "The watchdog cluster YAML file")
+	dir := flags.String("out", ".", "The directory to write ca.crt, ca.key and node<id>.crt/.key to")
+	days := flags.Int("days", 365, "How many days the node certificates are valid for")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if len(*clusterFile) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	raw, err := ioutil.ReadFile(*clusterFile)
+
+	if err != nil {
+		return err
+	}
+
+	cluster, err := watchdog.ParseCluster(raw)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		return err
+	}
+
+	ca, err := loadOrCreateCA(*dir)
+
+	if err != nil {
+		return err
+	}
+
+	for _, node := range cluster.Nodes() {
+		name := filepath.Join(*dir, fmt.Sprintf("node%d", node.Id()))
+
+		if err := issue(ca, node.Identity(), time.Duration(*days)*24*time.Hour, name); err != nil {
+			return err
+		}
+
+		log.Printf("Wrote %s.crt for node %d, as %q\n", name, node.Id(), node.Identity())
+	}
+
+	return nil
+}
+
+func loadOrCreateCA(dir string) (tls.Certificate, error) {
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+
+	if ca, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+		return ca, err
+	} else if !os.IsNotExist(err) {
+		return ca, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "watchdog CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err := writePEM(certFile, keyFile, der, key); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	log.Printf("Wrote a new CA to %s\n", certFile)
+
+	leaf, err := x509.ParseCertificate(der)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, err
+}
+
+// Writes name.crt & name.key, for identity. Each node both connects & is connected to, so it's for both.
+func issue(ca tls.Certificate, identity string, validFor time.Duration, name string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: identity},
+		DNSNames:     []string{identity},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+
+	if err != nil {
+		return err
+	}
+
+	return writePEM(name+".crt", name+".key", der, key)
+}
+
+func writePEM(certFile string, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func serialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return serial
+}
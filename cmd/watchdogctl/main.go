@@ -0,0 +1,219 @@
+// watchdogctl is an operator CLI for administering watchdog instances
+// through their HTTP monitor.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const usage = `Usage: watchdogctl <command> [flags]
+
+Commands:
+  activate    Activate a leader that is awaiting manual activation.
+  transfer    Transfer leadership away from a leader.
+  add-node    Add a node to the cluster, via the leader.
+  remove-node Remove a node from the cluster, via the leader.
+  certs       Generate a CA, and a TLS certificate for each node in a cluster file.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+
+	switch os.Args[1] {
+	case "activate":
+		err = activate(os.Args[2:])
+	case "transfer":
+		err = transfer(os.Args[2:])
+	case "add-node":
+		err = addNode(os.Args[2:])
+	case "remove-node":
+		err = removeNode(os.Args[2:])
+	case "certs":
+		err = certs(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func activate(args []string) error {
+	flags := flag.NewFlagSet("activate", flag.ExitOnError)
+	addr := flags.String("addr", "", "The HTTP address of the leader, e.g. http://validator1")
+	job := jobFlag(flags)
+	token := flags.String("token", os.Getenv("WATCHDOG_ACTIVATION_TOKEN"), "The activation token. Defaults to env WATCHDOG_ACTIVATION_TOKEN")
+	term := flags.Uint64("term", 0, "Only activate if the node is leading in this term")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if len(*addr) == 0 || len(*token) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	endpoint := *addr + "/activate"
+
+	if *term != 0 {
+		endpoint += "?term=" + strconv.FormatUint(*term, 10)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, endpoint, nil)
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+*token)
+
+	return do(request, *job)
+}
+
+func transfer(args []string) error {
+	flags := flag.NewFlagSet("transfer", flag.ExitOnError)
+	addr := flags.String("addr", "", "The HTTP address of the leader, e.g. http://validator1")
+	job := jobFlag(flags)
+	to := flags.String("to", "any", "The node ID to transfer leadership to, or any")
+	token := flags.String("token", os.Getenv("WATCHDOG_TRANSFER_TOKEN"), "The transfer token. Defaults to env WATCHDOG_TRANSFER_TOKEN")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if len(*addr) == 0 || len(*token) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, *addr+"/transfer?id="+url.QueryEscape(*to), nil)
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+*token)
+
+	return do(request, *job)
+}
+
+func addNode(args []string) error {
+	flags := flag.NewFlagSet("add-node", flag.ExitOnError)
+	addr := flags.String("addr", "", "The HTTP address of the leader, e.g. http://validator1")
+	job := jobFlag(flags)
+	id := flags.Uint("id", 0, "The new node's ID")
+	udpAddr := flags.String("udp-addr", "", "The new node's UDP address, e.g. validator6:6000")
+	httpAddr := flags.String("http-addr", "", "The new node's HTTP address, e.g. http://validator6")
+	role := flags.String("role", "voter", "The new node's role: voter, witness or observer")
+	priority := flags.Int("priority", 0, "The new node's priority")
+	identity := flags.String("identity", "", "The subject of the new node's TLS certificate. Defaults to the host in -udp-addr")
+	token := membershipTokenFlag(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if len(*addr) == 0 || *id == 0 || len(*token) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	query := url.Values{}
+	query.Set("id", strconv.FormatUint(uint64(*id), 10))
+	query.Set("udpAddr", *udpAddr)
+	query.Set("httpAddr", *httpAddr)
+	query.Set("role", *role)
+	query.Set("priority", strconv.Itoa(*priority))
+	query.Set("identity", *identity)
+
+	request, err := http.NewRequest(http.MethodPost, *addr+"/membership/add?"+query.Encode(), nil)
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+*token)
+
+	return do(request, *job)
+}
+
+func removeNode(args []string) error {
+	flags := flag.NewFlagSet("remove-node", flag.ExitOnError)
+	addr := flags.String("addr", "", "The HTTP address of the leader, e.g. http://validator1")
+	job := jobFlag(flags)
+	id := flags.Uint("id", 0, "The ID of the node to remove")
+	token := membershipTokenFlag(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if len(*addr) == 0 || *id == 0 || len(*token) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, *addr+"/membership/remove?id="+strconv.FormatUint(uint64(*id), 10), nil)
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+*token)
+
+	return do(request, *job)
+}
+
+// Changing membership needs the watchdog's membership token.
+func membershipTokenFlag(flags *flag.FlagSet) *string {
+	return flags.String("token", os.Getenv("WATCHDOG_MEMBERSHIP_TOKEN"), "The membership token. Defaults to env WATCHDOG_MEMBERSHIP_TOKEN")
+}
+
+// Every command may be for a particular job, for watchdogs running several.
+func jobFlag(flags *flag.FlagSet) *string {
+	return flags.String("job", "", "The job, if the watchdog runs several. Defaults to the first")
+}
+
+func do(request *http.Request, job string) error {
+	if len(job) > 0 {
+		query := request.URL.Query()
+		query.Set("job", job)
+		request.URL.RawQuery = query.Encode()
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+
+	response, err := client.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+
+		return fmt.Errorf("request failed: %d - %s", response.StatusCode, body)
+	}
+
+	log.Println("OK")
+
+	return nil
+}
@@ -23,9 +23,9 @@ func GetIntParam(name string, values url.Values) (int, error) {
 // HandleSse supports serve-sent-events, which are long running connections where the server
 // will periodically send new data to the client.
 // Send byte data to the first returned channel to send this data to the client.
-// The second channel will receive a bool once the SSE is complete (because the client
+// The second channel is closed once the SSE is complete (because the client
 // disconnected). This can be used to terminate a background goroutine that is sending
-// data to the client.
+// data to the client, which should select on it when sending so it is never left blocked.
 // Finally, the func returned should be called in the current goroutine where the HTTP
 // request is being handled. It is important the calling HandleFunc code does not return, as that
 // will terminate the SSE conn prematurely.
@@ -41,10 +41,7 @@ func HandleSse(w http.ResponseWriter, r *http.Request) (chan<- []byte, <-chan bo
 	flusher := w.(http.Flusher)
 
 	return messages, done, func() {
-		defer func() {
-			close(messages)
-			done <- true
-		}()
+		defer close(done)
 
 		for {
 			select {
@@ -1,31 +1,83 @@
 package util
 
+import (
+	"context"
+	"sync"
+)
+
 // Queue ensures that functions are executed synchronously.
 // This is intended to be used without timeout-based code,
 // where timers execute code on different goroutines.
 // By adding this functions to a queue, we ensure that
 // these critical functions do not execute at the same time.
 //
-// These currently cannot be stopped/cleaned up and assume
-// they execute until the end of the process.
-type Queue chan func()
+// Once stopped, a Queue executes nothing more, and
+// functions added to it are discarded.
+type Queue struct {
+	fns   chan func()
+	start sync.Once
+	stop  sync.Once
+	// Closed when the queue is asked to stop, and once it has.
+	stopping chan struct{}
+	stopped  chan struct{}
+}
+
+func NewQueue() *Queue {
+	return &Queue{
+		fns:      make(chan func()),
+		stopping: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
 
 // A Queue must be started before it does anything.
 // This will start the queue processing on a separate
-// goroutine.
+// goroutine. Starting it again does nothing.
 func (q *Queue) Start() {
-	go func() {
-		for {
-			(<- *q)()
-		}
-	}()
+	q.start.Do(func() {
+		go func() {
+			defer close(q.stopped)
+
+			for {
+				select {
+				case fn := <-q.fns:
+					fn()
+				case <-q.stopping:
+					return
+				}
+			}
+		}()
+	})
+}
+
+// Stops the queue once the function executing now (if any) has finished,
+// waiting for that until ctx is done. The queue must have been started.
+func (q *Queue) Stop(ctx context.Context) error {
+	q.stop.Do(func() {
+		close(q.stopping)
+	})
+
+	select {
+	case <-q.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Queues a function for execution.
 // This will execute immediately in the Queue's goroutine (assuming Start has been called)
-// or later if current functions are executing/queued.
-func (q *Queue) Enqueue(in func()) {
-	*q <- in
+// or later if current functions are executing/queued. This must not be called from a
+// function executing on the queue, which would wait on itself.
+//
+// Reports false, without executing the function, if the queue has been stopped.
+func (q *Queue) Enqueue(in func()) bool {
+	select {
+	case q.fns <- in:
+		return true
+	case <-q.stopping:
+		return false
+	}
 }
 
 // A convenience version of Enqueue which returns
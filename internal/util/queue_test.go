@@ -0,0 +1,74 @@
+package util
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestQueueStopLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	q := NewQueue()
+	q.Start()
+	q.Start()
+
+	ran := 0
+
+	for i := 0; i < 3; i++ {
+		if !q.Enqueue(func() { ran++ }) {
+			t.Fatal("the queue refused a function before it was stopped")
+		}
+	}
+
+	if err := q.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if ran != 3 {
+		t.Fatalf("the queue ran %d functions, expected 3", ran)
+	}
+
+	if q.Enqueue(func() { ran++ }) {
+		t.Fatal("the queue accepted a function after it was stopped")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines were left running", runtime.NumGoroutine()-before)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueueStopWaitsForTheRunningFunction(t *testing.T) {
+	q := NewQueue()
+	q.Start()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	go q.Enqueue(func() {
+		close(started)
+		<-release
+	})
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := q.Stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Stop should wait for the running function, got %v", err)
+	}
+
+	close(release)
+
+	if err := q.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,152 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RotatingWriter writes to a file, rotating it once it reaches a maximum size.
+// The current file is always at path. When rotated, it becomes path.1, path.1
+// becomes path.2 and so on, keeping at most maxFiles rotated files.
+type RotatingWriter struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// Opens (or creates) the file at path for appending, creating its directory if need be.
+func NewRotatingWriter(path string, maxSize int64, maxFiles int) (*RotatingWriter, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("A rotating log must have a positive max size\n")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	w := &RotatingWriter{path: path, maxSize: maxSize, maxFiles: maxFiles}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *RotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = info.Size()
+
+	return nil
+}
+
+// Writes p to the current file, rotating it first if p would take it over the max size.
+// A single write larger than the max size is written to a file of its own.
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+
+	return n, err
+}
+
+func (w *RotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	// Drop the oldest, then shuffle the rest along.
+	os.Remove(w.rotated(w.maxFiles))
+
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		os.Rename(w.rotated(i), w.rotated(i+1))
+	}
+
+	if w.maxFiles > 0 {
+		if err := os.Rename(w.path, w.rotated(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.path); err != nil {
+		return err
+	}
+
+	return w.open()
+}
+
+func (w *RotatingWriter) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
+
+// Tail returns up to the last n lines written, reading into
+// rotated files if the current one does not have enough.
+func (w *RotatingWriter) Tail(n int) ([][]byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lines := make([][]byte, 0)
+
+	for i := 0; i <= w.maxFiles && len(lines) < n; i++ {
+		path := w.path
+
+		if i > 0 {
+			path = w.rotated(i)
+		}
+
+		data, err := ioutil.ReadFile(path)
+
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		fileLines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+
+		if len(data) == 0 {
+			fileLines = nil
+		}
+
+		if len(fileLines) > n-len(lines) {
+			fileLines = fileLines[len(fileLines)-(n-len(lines)):]
+		}
+
+		lines = append(fileLines, lines...)
+	}
+
+	return lines, nil
+}
+
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.file.Close()
+}
@@ -0,0 +1,125 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingWriterRotatesPastItsMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "stdout.log")
+	w, err := NewRotatingWriter(path, 20, 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer w.Close()
+
+	// Ten bytes each, so two fit in a file.
+	for i := 0; i < 7; i++ {
+		if _, err := fmt.Fprintf(w, "line %04d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first two files' worth have been rotated away.
+	for file, expected := range map[string]string{
+		path:        "line 0006\n",
+		path + ".1": "line 0004\nline 0005\n",
+		path + ".2": "line 0002\nline 0003\n",
+	} {
+		data, err := os.ReadFile(file)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != expected {
+			t.Errorf("%s has %q, expected %q", filepath.Base(file), data, expected)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than 2 rotated files were kept")
+	}
+
+	// Tail reads back into the rotated files, oldest first.
+	lines, err := w.Tail(4)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(bytes.Join(lines, []byte(","))); got != "line 0003,line 0004,line 0005,line 0006" {
+		t.Errorf("the last 4 lines were %s", got)
+	}
+
+	// Asking for more than is kept returns what there is.
+	if lines, err = w.Tail(100); err != nil || len(lines) != 5 {
+		t.Errorf("expected the 5 lines kept, got %d (%v)", len(lines), err)
+	}
+}
+
+func TestRotatingWriterGivesAnOversizeWriteItsOwnFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stdout.log")
+	w, err := NewRotatingWriter(path, 10, 3)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer w.Close()
+
+	large := strings.Repeat("x", 25) + "\n"
+
+	for _, data := range []string{"small\n", large, "after\n"} {
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, expected := range map[string]string{path: "after\n", path + ".1": large, path + ".2": "small\n"} {
+		if data, err := os.ReadFile(file); err != nil || string(data) != expected {
+			t.Errorf("%s has %q (%v), expected %q", filepath.Base(file), data, err, expected)
+		}
+	}
+}
+
+func TestRotatingWriterCountsWhatIsAlreadyThere(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stdout.log")
+
+	if err := os.WriteFile(path, []byte("from before\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewRotatingWriter(path, 20, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer w.Close()
+
+	if _, err := w.Write([]byte("and now\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// That fits alongside what was there, but this doesn't.
+	if _, err := w.Write([]byte("and more\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(path + ".1"); err != nil || string(data) != "from before\nand now\n" {
+		t.Errorf("the rotated file has %q (%v)", data, err)
+	}
+}
+
+func TestRotatingWriterNeedsAMaxSize(t *testing.T) {
+	if _, err := NewRotatingWriter(filepath.Join(t.TempDir(), "stdout.log"), 0, 1); err == nil {
+		t.Fatal("a rotating writer was made without a max size")
+	}
+}
@@ -0,0 +1,75 @@
+package watchdog
+
+import (
+	"crypto/subtle"
+	"fmt"
+)
+
+const (
+	subStateAwaitingActivation = "awaiting-activation"
+	// Leading, with the process started but not yet ready.
+	subStateStarting = "starting"
+	// Leading, with the process ready.
+	subStateActive = "active"
+)
+
+// Activate confirms that this leader may start its process. This is only
+// needed in manual recovery mode, where a newly elected leader waits for an
+// operator rather than starting the process on its own.
+//
+// If term is non-zero, activation only succeeds if we are still leading in that
+// term. This stops an operator activating a different leadership to the one
+// they inspected.
+func (w *Watchdog) Activate(term uint64) error {
+	result := make(chan error, 1)
+
+	if !w.timers.sync(func() {
+		result <- w.activate(term)
+	}) {
+		return errShutdown
+	}
+
+	return <-result
+}
+
+func (w *Watchdog) activate(term uint64) error {
+	if w.state != StateLeading || !w.awaitingActivation {
+		return fmt.Errorf("Cannot activate: this node is not awaiting activation\n")
+	}
+
+	if term != 0 && term != w.currentTerm {
+		return fmt.Errorf("Cannot activate: leading in term %d, not %d\n", w.currentTerm, term)
+	}
+
+	w.event("activated")
+	w.awaitingActivation = false
+	w.canRunProcess = true
+
+	return nil
+}
+
+// Reports whether the token matches our configured activation token.
+func (w *Watchdog) isActivationToken(token string) bool {
+	if len(w.config.activationToken) == 0 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(w.config.activationToken)) == 1
+}
+
+// A finer-grained description of our state, if there is one.
+func (w *Watchdog) subState() string {
+	if w.state == StateLeading && w.awaitingActivation {
+		return subStateAwaitingActivation
+	}
+
+	if w.state == StateLeading && w.canRunProcess {
+		if w.isReady() {
+			return subStateActive
+		}
+
+		return subStateStarting
+	}
+
+	return ""
+}
@@ -0,0 +1,217 @@
+package watchdog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With a keys file configured, every message is authenticated with an HMAC-SHA256,
+// using a secret shared by every node. This stops anyone who can reach our port
+// forging or replaying messages, but does not hide them. The sealed layout is:
+//   [0:n]       the message
+//   [n:n+2]     key id
+//   [n+2:n+4]   the node it is for, so it can't be replayed to another node
+//   [n+4:n+12]  counter, our clock in nanoseconds (strictly increasing)
+//   [n+12:]     HMAC-SHA256 over everything before it
+const authTrailerLength = 2 + 2 + 8 + sha256.Size
+
+// Shorter secrets are too easy to guess.
+const minSecretLength = 16
+
+type authConfig struct {
+	keysFile string
+	// How old (or how far in the future) a message may be, by its counter, before it is refused.
+	maxAge time.Duration
+}
+
+func (c authConfig) enabled() bool {
+	return len(c.keysFile) > 0
+}
+
+type authKeyInput struct {
+	Id     uint16 `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+// The keys file. Keys are rotated by adding a new key to every node, then signing with it
+// on every node, and then removing the old one: a node accepts messages under any listed key.
+type keysInput struct {
+	SignWith uint16         `yaml:"signWith"`
+	Keys     []authKeyInput `yaml:"keys"`
+}
+
+type authenticator struct {
+	signWith uint16
+	keys     map[uint16][]byte
+	maxAge   time.Duration
+	clock    Clock
+
+	mu sync.Mutex
+	// The last counter we sent.
+	counter uint64
+	// The counters we have accepted from each node, for as long as they're not too old.
+	seen map[Id]map[uint64]bool
+
+	// How many messages we've refused.
+	unauthenticated uint64
+	replayed        uint64
+}
+
+// Loads the keys file, or returns nil if authentication isn't configured.
+func newAuthenticator(config authConfig, clock Clock) (*authenticator, error) {
+	if !config.enabled() {
+		return nil, nil
+	}
+
+	raw, err := os.ReadFile(config.keysFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not read keys file: %s\n", err.Error())
+	}
+
+	var input keysInput
+
+	if err := yaml.Unmarshal(raw, &input); err != nil {
+		return nil, fmt.Errorf("Keys file %s is invalid: %s\n", config.keysFile, err.Error())
+	}
+
+	a := &authenticator{
+		signWith: input.SignWith,
+		keys:     make(map[uint16][]byte),
+		maxAge:   config.maxAge,
+		clock:    clock,
+		seen:     make(map[Id]map[uint64]bool),
+	}
+
+	for _, key := range input.Keys {
+		secret, err := base64.StdEncoding.DecodeString(key.Secret)
+
+		if err != nil {
+			return nil, fmt.Errorf("Key %d in %s is not valid base64: %s\n", key.Id, config.keysFile, err.Error())
+		} else if key.Id == 0 {
+			return nil, fmt.Errorf("Every key in %s must have an id\n", config.keysFile)
+		} else if _, ok := a.keys[key.Id]; ok {
+			return nil, fmt.Errorf("Key %d is in %s twice\n", key.Id, config.keysFile)
+		} else if len(secret) < minSecretLength {
+			return nil, fmt.Errorf("Key %d in %s must be at least %d bytes\n", key.Id, config.keysFile, minSecretLength)
+		}
+
+		a.keys[key.Id] = secret
+	}
+
+	if _, ok := a.keys[a.signWith]; !ok {
+		return nil, fmt.Errorf("signWith in %s must be one of its keys\n", config.keysFile)
+	}
+
+	return a, nil
+}
+
+// Signs data for the node it is being sent to.
+func (a *authenticator) seal(data []byte, to Id) []byte {
+	a.mu.Lock()
+	counter := uint64(a.clock.Now().UnixNano())
+
+	if counter <= a.counter {
+		counter = a.counter + 1
+	}
+
+	a.counter = counter
+	a.mu.Unlock()
+
+	sealed := make([]byte, len(data)+authTrailerLength)
+	n := copy(sealed, data)
+	binary.BigEndian.PutUint16(sealed[n:n+2], a.signWith)
+	binary.BigEndian.PutUint16(sealed[n+2:n+4], uint16(to))
+	binary.BigEndian.PutUint64(sealed[n+4:n+12], counter)
+	copy(sealed[n+12:], a.mac(a.keys[a.signWith], sealed[:n+12]))
+
+	return sealed
+}
+
+// Checks the HMAC, returning the message, the node it is for and its counter, or why it isn't authentic.
+func (a *authenticator) open(sealed []byte) ([]byte, Id, uint64, error) {
+	if len(sealed) < authTrailerLength {
+		atomic.AddUint64(&a.unauthenticated, 1)
+		return nil, NullId, 0, fmt.Errorf("it is not authenticated")
+	}
+
+	n := len(sealed) - authTrailerLength
+	keyId := binary.BigEndian.Uint16(sealed[n : n+2])
+	key, ok := a.keys[keyId]
+
+	if !ok {
+		atomic.AddUint64(&a.unauthenticated, 1)
+		return nil, NullId, 0, fmt.Errorf("it is signed with unknown key %d", keyId)
+	}
+
+	if !hmac.Equal(sealed[n+12:], a.mac(key, sealed[:n+12])) {
+		atomic.AddUint64(&a.unauthenticated, 1)
+		return nil, NullId, 0, fmt.Errorf("its HMAC (with key %d) is invalid", keyId)
+	}
+
+	return sealed[:n], Id(binary.BigEndian.Uint16(sealed[n+2 : n+4])), binary.BigEndian.Uint64(sealed[n+4 : n+12]), nil
+}
+
+// Refuses a message that was sent to another node, e.g. a vote replayed to a second candidate.
+// Otherwise, refuses a counter from a node that we've already accepted, or which is too old to
+// tell. Messages may arrive out of order, so any unseen counter within maxAge is accepted.
+func (a *authenticator) accept(from Id, to Id, self Id, counter uint64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if to != self {
+		atomic.AddUint64(&a.replayed, 1)
+		return fmt.Errorf("NET: Dropping message from %d that was sent to %d, as it could be a replay\n", from, to)
+	}
+
+	now := a.clock.Now().UnixNano()
+	oldest := uint64(now - a.maxAge.Nanoseconds())
+
+	if counter < oldest || counter > uint64(now+a.maxAge.Nanoseconds()) {
+		atomic.AddUint64(&a.replayed, 1)
+		return fmt.Errorf("NET: Dropping message from %d that is %s old, as it could be a replay\n", from, time.Duration(now-int64(counter)))
+	}
+
+	seen, ok := a.seen[from]
+
+	if !ok {
+		seen = make(map[uint64]bool)
+		a.seen[from] = seen
+	}
+
+	if seen[counter] {
+		atomic.AddUint64(&a.replayed, 1)
+		return fmt.Errorf("NET: Dropping replayed message from %d\n", from)
+	}
+
+	seen[counter] = true
+
+	// Anything older would be refused anyway, so needn't be remembered.
+	for c := range seen {
+		if c < oldest {
+			delete(seen, c)
+		}
+	}
+
+	return nil
+}
+
+func (a *authenticator) mac(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write(data)
+
+	return h.Sum(nil)
+}
+
+// How many messages we have dropped, as they weren't authentic or were replays.
+func (a *authenticator) dropped() (unauthenticated uint64, replayed uint64) {
+	return atomic.LoadUint64(&a.unauthenticated), atomic.LoadUint64(&a.replayed)
+}
@@ -0,0 +1,107 @@
+package watchdog
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Keeps whatever is sent, for the test to deliver.
+type capturingTransport struct {
+	sent [][]byte
+}
+
+func (t *capturingTransport) Listen(string, func([]byte, net.Addr), func(error)) error {
+	return nil
+}
+
+func (t *capturingTransport) Send(addr string, data []byte) error {
+	t.sent = append(t.sent, data)
+	return nil
+}
+
+func (t *capturingTransport) Close() error {
+	return nil
+}
+
+// An adapter for node self, authenticating with a shared key.
+func authTestAdapter(t *testing.T, keysFile string, cluster *Cluster, self Id) (*adapter, *capturingTransport) {
+	auth, err := newAuthenticator(authConfig{keysFile, 10 * time.Second}, realClock{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &capturingTransport{}
+
+	a := makeAdapter()
+	a.nodes.update(jobId(DefaultJob), *cluster)
+	a.self = self
+	a.auth = auth
+	a.transport = transport
+
+	return a, transport
+}
+
+func TestAuthRefusesMessagesReplayedToAnotherNode(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.yaml")
+	keys := "signWith: 1\nkeys:\n  - id: 1\n    secret: \"MDEyMzQ1Njc4OWFiY2RlZg==\"\n"
+
+	if err := os.WriteFile(keysFile, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cluster, err := ParseCluster([]byte(`
+nodes:
+  - {id: 1, udpAddr: "node1:6000", httpAddr: "http://node1"}
+  - {id: 2, udpAddr: "node2:6000", httpAddr: "http://node2"}
+  - {id: 3, udpAddr: "node3:6000", httpAddr: "http://node3"}
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	voter, sent := authTestAdapter(t, keysFile, &cluster, 1)
+	candidate2, _ := authTestAdapter(t, keysFile, &cluster, 2)
+	candidate3, _ := authTestAdapter(t, keysFile, &cluster, 3)
+
+	vote := message{id: 1, term: 5, mtype: MessageVote}
+
+	if err, _ := voter.send(2, "node2:6000", vote); err != nil {
+		t.Fatal(err)
+	}
+
+	from := &net.UDPAddr{}
+
+	if _, err := candidate2.receive(sent.sent[0], from); err != nil {
+		t.Fatalf("node 2 should accept the vote sent to it: %s", err)
+	}
+
+	if _, err := candidate2.receive(sent.sent[0], from); err == nil {
+		t.Fatal("node 2 accepted the same vote twice")
+	}
+
+	// Node 3 has never seen this counter, but the vote was not for it.
+	_, err = candidate3.receive(sent.sent[0], from)
+
+	if err == nil || !strings.Contains(err.Error(), "sent to 2") {
+		t.Fatalf("node 3 should refuse a vote sent to node 2, got %v", err)
+	}
+
+	if _, replayed := candidate3.auth.dropped(); replayed != 1 {
+		t.Fatalf("node 3 should count the vote as replayed, counted %d", replayed)
+	}
+
+	// Nor can the recipient be changed without breaking the HMAC.
+	tampered := append([]byte{}, sent.sent[0]...)
+	n := len(tampered) - authTrailerLength
+	tampered[n+3] = 3
+
+	if _, err := candidate3.receive(tampered, from); err == nil || !strings.Contains(err.Error(), "HMAC") {
+		t.Fatalf("node 3 should refuse a vote readdressed to it, got %v", err)
+	}
+}
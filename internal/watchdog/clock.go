@@ -0,0 +1,29 @@
+package watchdog
+
+import "time"
+
+// A Clock tells the time, and calls functions once a duration has passed on it.
+// The election's timers and bookkeeping use one, so that a simulation can swap
+// the real clock for a virtual one (see Simulation). Running the process does not: it
+// runs in real time, though the supervisor's tests swap in their own clock.
+type Clock interface {
+	Now() time.Time
+	// Calls f, on its own goroutine, once d has passed.
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+// A call scheduled with Clock.AfterFunc. *time.Timer is one.
+type ClockTimer interface {
+	// Stops the call being made, reporting false if it already has been (or was stopped).
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
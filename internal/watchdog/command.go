@@ -0,0 +1,157 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// How often we check on the process, to (re)start it or see whether it has stopped.
+const processCheckInterval = 100 * time.Millisecond
+
+// Runs the configured command whilst leading, as our Callbacks. The process is
+// restarted according to the restart policy, and once leadership is lost, it's
+// stopped and its post-stop hooks are run.
+type commandRunner struct {
+	w *Watchdog
+}
+
+func (c commandRunner) OnStartedLeading(ctx context.Context) {
+	token, _ := FencingTokenFrom(ctx)
+
+	for {
+		c.w.startProcess(ctx, token)
+
+		select {
+		case <-ctx.Done():
+			c.w.stopProcess()
+			return
+		case <-time.After(processCheckInterval):
+		}
+	}
+}
+
+func (c commandRunner) OnStoppedLeading() {}
+
+func (c commandRunner) OnNewLeader(id Id) {}
+
+// The process is ready once it has passed its readiness probe.
+func (c commandRunner) ready() bool {
+	return c.w.processReady
+}
+
+// Starts the process for the leadership, if it's not running and may be (re)started.
+// ctx is the leadership's, as given to OnStartedLeading.
+func (w *Watchdog) startProcess(ctx context.Context, token FencingToken) {
+	if !w.supervisor.canStart(token) {
+		// Either running already, or not allowed to restart (yet).
+		return
+	}
+
+	if !w.acquireResources(token) {
+		return
+	}
+
+	// The pre-start hooks may have taken a while, and leadership may have been lost
+	// meanwhile. If so, the resources are released once ctx is done.
+	if ctx.Err() != nil || !w.stillLeading(token) {
+		return
+	}
+
+	attr := new(os.ProcAttr)
+	// Pass our environment through, along with the leadership
+	// this process is running under.
+	attr.Env = append(w.config.command.exec.environment(), token.environment()...)
+	// So that anything it forks can be stopped along with it.
+	attr.Sys = groupAttributes()
+
+	closePipes, err := w.captureOutput(attr)
+
+	if err != nil {
+		w.error(err)
+		return
+	}
+
+	p, err := w.config.command.exec.start(w.config.command.command, token.expandArgs(w.config.command.args), attr)
+	closePipes()
+
+	if err != nil {
+		w.error(err)
+		w.timers.sync(func() {
+			w.event(fmt.Sprintf("failed to start process: %s", err.Error()))
+		})
+		w.supervisor.startFailed()
+		return
+	}
+
+	w.timers.sync(func() {
+		w.event(fmt.Sprintf("started process %d with fencing token %s", p.Pid, token))
+	})
+
+	w.supervisor.started(p, token)
+
+	w.routines.Add(1)
+
+	go func() {
+		defer w.routines.Done()
+
+		w.watchProcess(p, token)
+	}()
+}
+
+// Stops the process, waiting for it to exit, and then releases its resources.
+func (w *Watchdog) stopProcess() {
+	if err := w.supervisor.terminate(); err != nil {
+		w.error(err)
+	}
+
+	for w.isProcessRunning() {
+		time.Sleep(processCheckInterval)
+	}
+
+	w.releaseResources()
+}
+
+// Whether we still lead, and may work as leader, under token.
+func (w *Watchdog) stillLeading(token FencingToken) bool {
+	status, ok := w.status()
+
+	return ok && status.active && status.term == token.Term
+}
+
+func (w *Watchdog) isProcessRunning() bool {
+	return w.supervisor.running()
+}
+
+func (w *Watchdog) onProcessExit(exit processExit) {
+	if exit.cleanup != nil {
+		w.error(exit.cleanup)
+	}
+
+	w.timers.sync(func() {
+		w.processReady = false
+
+		switch {
+		case exit.state == nil:
+			w.event(fmt.Sprintf("lost track of process started with fencing token %s", exit.token))
+		case exit.unhealthy:
+			w.event(fmt.Sprintf("process stopped as it failed its liveness probe (%s)", exit.state.String()))
+		case exit.killed:
+			w.event(fmt.Sprintf("process killed, as it did not stop within %s", w.config.command.stop.gracePeriod))
+		case exit.requested:
+			w.event(fmt.Sprintf("process stopped (%s)", exit.state.String()))
+		default:
+			w.event(fmt.Sprintf("process exited unexpectedly with code %d (%s)", exit.state.ExitCode(), exit.state.String()))
+		}
+	})
+}
+
+// Our process keeps crashing, so give another node a go at running it.
+func (w *Watchdog) onProcessCrashLoop() {
+	w.timers.sync(func() {
+		restart := w.config.command.restart
+
+		w.stepDown(fmt.Sprintf("process crashed %d times within %s", restart.maxCrashes, restart.crashWindow))
+	})
+}
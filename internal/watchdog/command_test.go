@@ -0,0 +1,85 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// Node 1 of a cluster of one, leading in term 1 and past its grace period, but without
+// its election running. command is the command's configuration, indented to go under it.
+func leadingTestWatchdog(t *testing.T, command string) *Watchdog {
+	config, err := ParseConfiguration([]byte(`
+minElectionTimeout: 50
+maxElectionTimeout: 100
+networkInterval: 200
+heartbeatInterval: 20
+listenOn: "127.0.0.1:0"
+command:
+` + command))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewWatchdog(1, config, leakTestCluster(t, []string{"127.0.0.1:0"}))
+	rank, ranks := w.cluster.priorityRank(w.id)
+
+	w.timers = newTimers(w.config, w.clock, w.random, rank, ranks, func() {}, func() {}, func() {}, func() {}, func() {})
+
+	t.Cleanup(func() {
+		_ = w.timers.shutdown(context.Background())
+	})
+
+	w.currentTerm = 1
+	w.state = StateLeading
+	w.canRunProcess = true
+
+	return w
+}
+
+func TestProcessIsNotStartedOnceLeadershipIsLostDuringPreStartHooks(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+
+	if err != nil {
+		t.Skip("sh is needed for the command & hook")
+	}
+
+	w := leadingTestWatchdog(t, fmt.Sprintf(`
+  name: %[1]q
+  args: [sh, -c, "sleep 60"]
+  hooks:
+    preStart:
+      - {name: %[1]q, args: [sh, -c, "sleep 0.5"]}
+`, sh))
+
+	token := FencingToken{1, w.id}
+	returned := make(chan struct{})
+
+	go func() {
+		defer close(returned)
+
+		w.startProcess(context.Background(), token)
+	}()
+
+	// Deposed whilst the hook runs.
+	time.Sleep(100 * time.Millisecond)
+
+	w.timers.sync(func() {
+		w.newTerm(2)
+		w.transition(StateFollowing)
+	})
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("startProcess did not return")
+	}
+
+	if w.supervisor.running() {
+		_ = w.supervisor.terminate()
+		t.Fatal("the process was started after leadership was lost")
+	}
+}
@@ -3,15 +3,31 @@ package watchdog
 import (
 	"fmt"
 	"gopkg.in/yaml.v2"
+	"math"
 	"net"
+	"os"
+	"os/user"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// Describes a node, both in the cluster file and when
+// replicating membership changes between nodes.
 type nodeInput struct {
-	Id       uint8  `yaml:"id"`
-	UdpAddr  string `yaml:"udpAddr"`
-	HttpAddr string `yaml:"httpAddr"`
+	Id       uint16 `yaml:"id" json:"id"`
+	UdpAddr  string `yaml:"udpAddr" json:"udpAddr"`
+	HttpAddr string `yaml:"httpAddr" json:"httpAddr"`
+	Priority int    `yaml:"priority" json:"priority"`
+	Role     string `yaml:"role" json:"role"`
+	// The subject its TLS certificate must have. Defaults to the host in udpAddr.
+	Identity string `yaml:"identity" json:"identity,omitempty"`
+	// Where the node finds its own TLS certificate & key, with the TLS transport.
+	TlsCert string `yaml:"tlsCert" json:"tlsCert,omitempty"`
+	TlsKey  string `yaml:"tlsKey" json:"tlsKey,omitempty"`
 }
 
 func (n nodeInput) validate() error {
@@ -27,13 +43,67 @@ func (n nodeInput) validate() error {
 		return fmt.Errorf("A node must have an httpAddr")
 	}
 
+	switch Role(n.Role) {
+	case "", RoleVoter, RoleWitness, RoleObserver:
+	default:
+		return fmt.Errorf("Node %d has unknown role %q", n.Id, n.Role)
+	}
+
 	return nil
 }
 
+func (n nodeInput) node() Node {
+	role := Role(n.Role)
+
+	if role == "" {
+		role = RoleVoter
+	}
+
+	identity := n.Identity
+
+	if identity == "" {
+		if host, _, err := net.SplitHostPort(n.UdpAddr); err == nil {
+			identity = host
+		} else {
+			identity = n.UdpAddr
+		}
+	}
+
+	return Node{n.UdpAddr, n.HttpAddr, Id(n.Id), n.Priority, role, identity, n.TlsCert, n.TlsKey}
+}
+
+type Role string
+
+const (
+	// Votes, counts towards quorum and may lead (and so run the process).
+	RoleVoter Role = "voter"
+	// Votes and counts towards quorum, but never stands for election.
+	// A cheap way to break ties, e.g. from a third site.
+	RoleWitness Role = "witness"
+	// Follows the leader and reports its state, but neither votes
+	// nor counts towards quorum.
+	RoleObserver Role = "observer"
+)
+
+// Whether nodes with this role count towards a majority.
+func (r Role) votes() bool {
+	return r == RoleVoter || r == RoleWitness
+}
+
+// Whether nodes with this role may become leader.
+func (r Role) canLead() bool {
+	return r == RoleVoter
+}
+
 type Node struct {
 	udpAddr  string
 	httpAddr string
 	id       Id
+	priority int
+	role     Role
+	identity string
+	tlsCert  string
+	tlsKey   string
 }
 
 func (n Node) UdpAddr() string {
@@ -48,12 +118,97 @@ func (n Node) Id() Id {
 	return n.id
 }
 
+func (n Node) Priority() int {
+	return n.priority
+}
+
+func (n Node) Role() Role {
+	return n.role
+}
+
+// The subject of the node's TLS certificate.
+func (n Node) Identity() string {
+	return n.identity
+}
+
+func (n Node) input() nodeInput {
+	return nodeInput{uint16(n.id), n.udpAddr, n.httpAddr, n.priority, string(n.role), n.identity, n.tlsCert, n.tlsKey}
+}
+
+// NewNode describes a node that can be added to a running cluster.
+// Its identity defaults to the host in udpAddr if empty.
+func NewNode(id Id, udpAddr string, httpAddr string, role Role, priority int, identity string) (Node, error) {
+	input := nodeInput{uint16(id), udpAddr, httpAddr, priority, string(role), identity, "", ""}
+
+	if err := input.validate(); err != nil {
+		return Node{}, err
+	}
+
+	return input.node(), nil
+}
+
 type clusterInput struct {
-	Nodes []nodeInput `yaml:"nodes"`
+	Nodes      []nodeInput `yaml:"nodes"`
+	Preemption bool        `yaml:"preemption"`
 }
 
 type Cluster struct {
 	nodes map[Id]Node
+	// Incremented on every membership change. The cluster file is version 0.
+	version uint64
+	// Whether a leader should hand over to a healthy node with a higher priority.
+	preemption bool
+}
+
+// The membership of a cluster, as replicated between nodes & persisted.
+type membershipRecord struct {
+	Version uint64      `json:"version"`
+	Nodes   []nodeInput `json:"nodes"`
+}
+
+func (c Cluster) Version() uint64 {
+	return c.version
+}
+
+func (c Cluster) record() membershipRecord {
+	record := membershipRecord{c.version, make([]nodeInput, 0)}
+
+	for _, node := range c.Nodes() {
+		record.Nodes = append(record.Nodes, node.input())
+	}
+
+	return record
+}
+
+// Builds the cluster described by a membership record, keeping our other settings.
+func (c Cluster) fromRecord(record membershipRecord) (Cluster, error) {
+	return newCluster(record.Nodes, record.Version, c.preemption)
+}
+
+// A copy of this cluster with the node added, at the next version.
+func (c Cluster) withNode(node Node) (Cluster, error) {
+	if _, ok := c.nodes[node.id]; ok {
+		return c, fmt.Errorf("Node %d is already in the cluster\n", node.id)
+	}
+
+	return newCluster(append(c.record().Nodes, node.input()), c.version+1, c.preemption)
+}
+
+// A copy of this cluster without the node, at the next version.
+func (c Cluster) withoutNode(id Id) (Cluster, error) {
+	if _, ok := c.nodes[id]; !ok {
+		return c, fmt.Errorf("Unknown node %d\n", id)
+	}
+
+	nodes := make([]nodeInput, 0)
+
+	for _, node := range c.record().Nodes {
+		if Id(node.Id) != id {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return newCluster(nodes, c.version+1, c.preemption)
 }
 
 func (c Cluster) Nodes() []Node {
@@ -75,38 +230,677 @@ func (c Cluster) Nodes() []Node {
 	return tmp
 }
 
-type cmdInput struct {
+type restartInput struct {
+	Policy         string `yaml:"policy"`
+	InitialBackoff uint   `yaml:"initialBackoff"`
+	MaxBackoff     uint   `yaml:"maxBackoff"`
+	MaxCrashes     *int   `yaml:"maxCrashes"`
+	CrashWindow    uint   `yaml:"crashWindow"`
+}
+
+func (r restartInput) parse() (restartConfig, error) {
+	config := restartConfig{
+		restartPolicy(r.Policy),
+		msIntToDuration(r.InitialBackoff),
+		msIntToDuration(r.MaxBackoff),
+		5,
+		msIntToDuration(r.CrashWindow),
+	}
+
+	switch config.policy {
+	case "":
+		config.policy = RestartAlways
+	case RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return config, fmt.Errorf("Unknown restart policy %q\n", r.Policy)
+	}
+
+	if r.InitialBackoff == 0 {
+		config.initialBackoff = 500 * time.Millisecond
+	}
+
+	if r.MaxBackoff == 0 {
+		config.maxBackoff = 30 * time.Second
+	}
+
+	if r.CrashWindow == 0 {
+		config.crashWindow = time.Minute
+	}
+
+	if r.MaxCrashes != nil {
+		config.maxCrashes = *r.MaxCrashes
+	}
+
+	if config.initialBackoff > config.maxBackoff {
+		return config, fmt.Errorf("restart initialBackoff must not be more than maxBackoff\n")
+	}
+
+	return config, nil
+}
+
+type stopInput struct {
+	Signal      string `yaml:"signal"`
+	GracePeriod uint   `yaml:"gracePeriod"`
+}
+
+func (s stopInput) parse() (stopConfig, error) {
+	config := stopConfig{syscall.SIGTERM, msIntToDuration(s.GracePeriod)}
+
+	if s.Signal != "" {
+		signal, ok := stopSignals[strings.ToUpper(s.Signal)]
+
+		if !ok {
+			return config, fmt.Errorf("Unknown stop signal %q\n", s.Signal)
+		}
+
+		config.signal = signal
+	}
+
+	if s.GracePeriod == 0 {
+		config.gracePeriod = 10 * time.Second
+	}
+
+	return config, nil
+}
+
+type logsInput struct {
+	Dir      string `yaml:"dir"`
+	MaxSize  int64  `yaml:"maxSize"`
+	MaxFiles *int   `yaml:"maxFiles"`
+}
+
+func (l logsInput) parse() (logsConfig, error) {
+	config := logsConfig{l.Dir, l.MaxSize, 5}
+
+	if config.maxSize == 0 {
+		config.maxSize = 10 * 1024 * 1024
+	}
+
+	if l.MaxFiles != nil {
+		config.maxFiles = *l.MaxFiles
+	}
+
+	if config.maxSize < 0 || config.maxFiles < 0 {
+		return config, fmt.Errorf("logs maxSize and maxFiles must not be negative\n")
+	}
+
+	return config, nil
+}
+
+type hookInput struct {
+	Name    string   `yaml:"name"`
+	Args    []string `yaml:"args"`
+	Timeout uint     `yaml:"timeout"`
+}
+
+type hooksInput struct {
+	PreStart []hookInput `yaml:"preStart"`
+	PostStop []hookInput `yaml:"postStop"`
+}
+
+func (h hooksInput) parse() (hooksConfig, error) {
+	var config hooksConfig
+	var err error
+
+	if config.preStart, err = parseHooks(h.PreStart); err != nil {
+		return config, err
+	}
+
+	config.postStop, err = parseHooks(h.PostStop)
+
+	return config, err
+}
+
+func parseHooks(inputs []hookInput) ([]hook, error) {
+	hooks := make([]hook, 0)
+
+	for _, input := range inputs {
+		if input.Name == "" {
+			return hooks, fmt.Errorf("A hook must have a name\n")
+		}
+
+		hooks = append(hooks, hook{input.Name, input.Args, durationOr(input.Timeout, 30*time.Second)})
+	}
+
+	return hooks, nil
+}
+
+type probeExecInput struct {
 	Name string   `yaml:"name"`
 	Args []string `yaml:"args"`
 }
 
+type probeInput struct {
+	// Exactly one of these, if probing at all.
+	Exec *probeExecInput `yaml:"exec"`
+	// A host:port to connect to.
+	Tcp string `yaml:"tcp"`
+	// A URL to get.
+	Http      string `yaml:"http"`
+	Interval  uint   `yaml:"interval"`
+	Timeout   uint   `yaml:"timeout"`
+	Threshold int    `yaml:"threshold"`
+	// Readiness only.
+	Deadline uint `yaml:"deadline"`
+}
+
+type probesInput struct {
+	Readiness probeInput `yaml:"readiness"`
+	Liveness  probeInput `yaml:"liveness"`
+}
+
+func (p probesInput) parse() (probesConfig, error) {
+	var config probesConfig
+	var err error
+
+	if config.readiness, err = p.Readiness.parse("readiness", 1); err != nil {
+		return config, err
+	}
+
+	if p.Liveness.Deadline != 0 {
+		return config, fmt.Errorf("Only the readiness probe has a deadline\n")
+	}
+
+	config.liveness, err = p.Liveness.parse("liveness", 3)
+
+	return config, err
+}
+
+// Nil if no probe is configured.
+func (p probeInput) parse(name string, defaultThreshold int) (*probe, error) {
+	kinds := 0
+	parsed := probe{
+		interval:  durationOr(p.Interval, time.Second),
+		timeout:   durationOr(p.Timeout, time.Second),
+		threshold: defaultThreshold,
+		deadline:  durationOr(p.Deadline, time.Minute),
+	}
+
+	if p.Exec != nil {
+		if p.Exec.Name == "" {
+			return nil, fmt.Errorf("The %s probe's exec must have a name\n", name)
+		}
+
+		kinds++
+		parsed.kind = ProbeExec
+		parsed.exec = hook{p.Exec.Name, p.Exec.Args, parsed.timeout}
+	}
+
+	if p.Tcp != "" {
+		kinds++
+		parsed.kind = ProbeTcp
+		parsed.target = p.Tcp
+	}
+
+	if p.Http != "" {
+		kinds++
+		parsed.kind = ProbeHttp
+		parsed.target = p.Http
+	}
+
+	if kinds == 0 {
+		return nil, nil
+	}
+
+	if kinds > 1 {
+		return nil, fmt.Errorf("The %s probe must be one of exec, tcp or http\n", name)
+	}
+
+	if p.Threshold < 0 {
+		return nil, fmt.Errorf("The %s probe's threshold must be positive\n", name)
+	} else if p.Threshold > 0 {
+		parsed.threshold = p.Threshold
+	}
+
+	return &parsed, nil
+}
+
+type cmdInput struct {
+	Name    string       `yaml:"name"`
+	Args    []string     `yaml:"args"`
+	Restart restartInput `yaml:"restart"`
+	Stop    stopInput    `yaml:"stop"`
+	// Whether to adopt anything orphaned by the command, so it can be reaped. Linux only.
+	Subreaper bool      `yaml:"subreaper"`
+	Logs      logsInput `yaml:"logs"`
+	// Each either NAME=value, or NAME to pass through our own value.
+	// If not set, the command gets our whole environment.
+	Env     []string          `yaml:"env"`
+	Dir     string            `yaml:"dir"`
+	User    string            `yaml:"user"`
+	Group   string            `yaml:"group"`
+	Umask   string            `yaml:"umask"`
+	Rlimits map[string]string `yaml:"rlimits"`
+	Hooks   hooksInput        `yaml:"hooks"`
+	Probes  probesInput       `yaml:"probes"`
+}
+
+func (c cmdInput) parse(required bool) (Cmd, error) {
+	var command Cmd
+
+	restart, err := c.Restart.parse()
+
+	if err != nil {
+		return command, err
+	}
+
+	stop, err := c.Stop.parse()
+
+	if err != nil {
+		return command, err
+	}
+
+	logs, err := c.Logs.parse()
+
+	if err != nil {
+		return command, err
+	}
+
+	exec, err := c.execSpec()
+
+	if err != nil {
+		return command, err
+	}
+
+	hooks, err := c.Hooks.parse()
+
+	if err != nil {
+		return command, err
+	}
+
+	probes, err := c.Probes.parse()
+
+	if err != nil {
+		return command, err
+	}
+
+	command = Cmd{c.Name, c.Args, restart, stop, c.Subreaper, logs, exec, hooks, probes}
+
+	if command.command == "" && required {
+		return command, fmt.Errorf("config did not contain a command")
+	}
+
+	return command, nil
+}
+
+func (c cmdInput) execSpec() (execSpec, error) {
+	spec := execSpec{dir: c.Dir, user: c.User, group: c.Group}
+
+	if c.Env != nil {
+		spec.env = make([]string, 0)
+		spec.envNames = make([]string, 0)
+
+		for _, entry := range c.Env {
+			parts := strings.SplitN(entry, "=", 2)
+			name, value, literal := parts[0], "", len(parts) == 2
+
+			if literal {
+				value = parts[1]
+			}
+
+			if name == "" {
+				return spec, fmt.Errorf("Invalid command env entry %q\n", entry)
+			}
+
+			if !literal {
+				var ok bool
+
+				if value, ok = os.LookupEnv(name); !ok {
+					return spec, fmt.Errorf("Command env %s is to be passed through, but is not set\n", name)
+				}
+			}
+
+			spec.env = append(spec.env, name+"="+value)
+			spec.envNames = append(spec.envNames, name)
+		}
+	}
+
+	if c.Dir != "" {
+		if info, err := os.Stat(c.Dir); err != nil {
+			return spec, fmt.Errorf("Invalid command dir: %s\n", err.Error())
+		} else if !info.IsDir() {
+			return spec, fmt.Errorf("Command dir %s is not a directory\n", c.Dir)
+		}
+	}
+
+	credential, err := parseCredential(c.User, c.Group)
+
+	if err != nil {
+		return spec, err
+	}
+
+	spec.credential = credential
+
+	if c.Umask != "" {
+		umask, err := strconv.ParseUint(c.Umask, 8, 32)
+
+		if err != nil || umask > 0777 {
+			return spec, fmt.Errorf("Command umask must be octal, e.g. 0027\n")
+		}
+
+		value := int(umask)
+		spec.umask = &value
+	}
+
+	names := make([]string, 0)
+
+	for name := range c.Rlimits {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		resource, ok := rlimitResources[name]
+
+		if !ok {
+			return spec, fmt.Errorf("Unknown or unsupported rlimit %q\n", name)
+		}
+
+		value := uint64(rlimitUnlimited)
+
+		if input := c.Rlimits[name]; input != "unlimited" {
+			if value, err = strconv.ParseUint(input, 10, 64); err != nil {
+				return spec, fmt.Errorf("rlimit %s must be a number or unlimited\n", name)
+			}
+		}
+
+		spec.rlimits = append(spec.rlimits, rlimit{name, resource, value})
+	}
+
+	return spec, nil
+}
+
+// The credential to run as the given user and/or group, each either a name or ID.
+// With only a user, their primary group is used. Nil if neither is set.
+func parseCredential(userInput string, groupInput string) (*syscall.Credential, error) {
+	if userInput == "" && groupInput == "" {
+		return nil, nil
+	}
+
+	credential := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+
+	if userInput != "" {
+		u, err := user.Lookup(userInput)
+
+		if _, ok := err.(user.UnknownUserError); ok {
+			u, err = user.LookupId(userInput)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid command user %q: %s\n", userInput, err.Error())
+		}
+
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+
+		credential.Uid = uint32(uid)
+		credential.Gid = uint32(gid)
+	}
+
+	if groupInput != "" {
+		g, err := user.LookupGroup(groupInput)
+
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(groupInput)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid command group %q: %s\n", groupInput, err.Error())
+		}
+
+		gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+
+		credential.Gid = uint32(gid)
+	}
+
+	changing := credential.Uid != uint32(os.Getuid()) || credential.Gid != uint32(os.Getgid())
+
+	if changing && os.Geteuid() != 0 {
+		return nil, fmt.Errorf("The watchdog must run as root to run the command as another user or group\n")
+	}
+
+	return credential, nil
+}
+
+type jobInput struct {
+	Name    string   `yaml:"name"`
+	Command cmdInput `yaml:"command"`
+	// Defaults to the top-level stateFile, with the job name added.
+	StateFile string `yaml:"stateFile"`
+}
+
+type recoveryInput struct {
+	Mode            string `yaml:"mode"`
+	ActivationToken string `yaml:"activationToken"`
+}
+
+type transportInput struct {
+	Type        string `yaml:"type"`
+	DialTimeout uint   `yaml:"dialTimeout"`
+	QueueLength int    `yaml:"queueLength"`
+	// Only for tls. Cert & key default to this node's tlsCert & tlsKey in the cluster file.
+	Ca   string `yaml:"ca"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+func (t transportInput) parse() (transportConfig, error) {
+	config := transportConfig{transportType(t.Type), msIntToDuration(t.DialTimeout), t.QueueLength, t.Ca, t.Cert, t.Key}
+
+	switch config.transport {
+	case "":
+		config.transport = TransportUDP
+	case TransportUDP, TransportTCP:
+	case TransportTLS:
+		if len(t.Ca) == 0 {
+			return config, fmt.Errorf("The tls transport needs a ca\n")
+		}
+	default:
+		return config, fmt.Errorf("Unknown transport type %q\n", t.Type)
+	}
+
+	if t.DialTimeout == 0 {
+		config.dialTimeout = time.Second
+	}
+
+	if t.QueueLength == 0 {
+		config.queueLength = 64
+	} else if t.QueueLength < 0 {
+		return config, fmt.Errorf("transport queueLength must not be negative\n")
+	}
+
+	return config, nil
+}
+
+type membershipInput struct {
+	// Required by the HTTP monitor to change membership. Changes are refused if not set.
+	Token string `yaml:"token"`
+}
+
+type transferInput struct {
+	// Required by the HTTP monitor to transfer leadership. Transfers are refused if not set.
+	Token string `yaml:"token"`
+}
+
+type authInput struct {
+	KeysFile string `yaml:"keysFile"`
+	MaxAge   uint   `yaml:"maxAge"`
+}
+
 type configurationInput struct {
 	MinElectionTimeout uint     `yaml:"minElectionTimeout"`
 	MaxElectionTimeout uint     `yaml:"maxElectionTimeout"`
 	NetworkInterval    uint     `yaml:"networkInterval"`
 	ListenOn           string   `yaml:"listenOn"`
+	Transport          transportInput `yaml:"transport"`
+	Auth               authInput `yaml:"auth"`
 	Command            cmdInput `yaml:"command"`
 	HeartbeatInterval  uint     `yaml:"heartbeatInterval"`
+	StateFile          string   `yaml:"stateFile"`
+	Recovery           recoveryInput `yaml:"recovery"`
+	Membership         membershipInput `yaml:"membership"`
+	Transfer           transferInput `yaml:"transfer"`
+	// The below default to networkInterval, except leadershipGraceTimeout,
+	// which defaults to the smallest safe value, and maxClockDrift.
+	LeadershipTimeout      uint `yaml:"leadershipTimeout"`
+	LeadershipAwareTimeout uint `yaml:"leadershipAwareTimeout"`
+	LeadershipGraceTimeout uint `yaml:"leadershipGraceTimeout"`
+	MaxClockDrift          uint `yaml:"maxClockDrift"`
+	// Several independently elected jobs, instead of a single command.
+	Jobs []jobInput `yaml:"jobs"`
 }
 
 type Cmd struct {
 	command string
 	args    []string
+	restart   restartConfig
+	stop      stopConfig
+	subreaper bool
+	logs      logsConfig
+	exec      execSpec
+	hooks     hooksConfig
+	probes    probesConfig
 }
 
+type recoveryMode string
+
+const (
+	// Elected leaders start the process on their own.
+	RecoveryAutomatic recoveryMode = "automatic"
+	// Elected leaders wait for an operator to activate them.
+	RecoveryManual recoveryMode = "manual"
+)
+
 type Configuration struct {
 	minElectionTimeout time.Duration
 	maxElectionTimeout time.Duration
 	networkInterval    time.Duration
-	listenOn           *net.UDPAddr
+	listenOn           string
+	transport          transportConfig
+	auth               authConfig
 	command            Cmd
 	heartbeatInterval  time.Duration
+	stateFile          string
+	recovery           recoveryMode
+	activationToken    string
+	membershipToken    string
+	transferToken      string
+	// How long a leader keeps leadership without hearing from a majority.
+	leadershipTimeout time.Duration
+	// How long a follower keeps following without hearing from its leader.
+	leadershipAwareTimeout time.Duration
+	// How long a new leader waits before starting the process.
+	leadershipGraceTimeout time.Duration
+	// How far timers on different nodes may disagree over these durations.
+	maxClockDrift time.Duration
+	// The job this configuration runs, and every job configured, if this is the first.
+	job   string
+	jobId uint32
+	jobs  []Configuration
+}
+
+// The configuration of each job to run, in the order configured.
+func (c Configuration) Jobs() []Configuration {
+	if len(c.jobs) == 0 {
+		return []Configuration{c}
+	}
+
+	return c.jobs
+}
+
+func (c Configuration) Job() string {
+	return c.job
 }
 
 func (c *Configuration) HalfInterval() time.Duration {
 	return time.Duration(c.networkInterval.Nanoseconds() / 2)
 }
 
+// The shortest leadershipGraceTimeout that ensures processes never overlap.
+//
+// A deposed leader may keep leading until its leadershipTimeout expires, counted
+// from the oldest of the latest heartbeats from a majority (see leaseRenewal). That
+// majority overlaps the majority that elected the new leader, and a follower stops sending
+// heartbeats before it votes, so this was no later than the election (give or take
+// network delays, which maxClockDrift allows for). It then has up to
+// its stop grace period for the process to exit, groupReapTimeout for anything left in
+// its group to go, and its post-stop hooks' timeouts to release its resources. A new leader that waits out all of that, plus the drift
+// between the nodes' clocks, cannot overlap with it. This assumes every node is
+// configured with the same timings.
+func (c *Configuration) minLeadershipGrace() time.Duration {
+	return c.leadershipTimeout + c.command.stop.gracePeriod + groupReapTimeout + c.command.hooks.maxPostStop() + c.maxClockDrift
+}
+
+func (c *Configuration) validateTimings() error {
+	if c.heartbeatInterval == 0 {
+		return fmt.Errorf("heartbeatInterval must be set\n")
+	}
+
+	if c.heartbeatInterval >= c.leadershipTimeout {
+		return fmt.Errorf("heartbeatInterval (%s) must be less than leadershipTimeout (%s)\n", c.heartbeatInterval, c.leadershipTimeout)
+	}
+
+	if c.heartbeatInterval >= c.leadershipAwareTimeout {
+		return fmt.Errorf("heartbeatInterval (%s) must be less than leadershipAwareTimeout (%s)\n", c.heartbeatInterval, c.leadershipAwareTimeout)
+	}
+
+	if min := c.minLeadershipGrace(); c.leadershipGraceTimeout < min {
+		return fmt.Errorf(
+			"leadershipGraceTimeout (%s) must be at least leadershipTimeout + command.stop.gracePeriod + 1s to reap its group + post-stop hook timeouts + maxClockDrift (%s), or processes may overlap\n",
+			c.leadershipGraceTimeout,
+			min,
+		)
+	}
+
+	return nil
+}
+
+// The priority of the given node. Unknown nodes have the lowest possible priority.
+func (c *Cluster) PriorityOf(id Id) int {
+	node, ok := c.nodes[id]
+
+	if !ok {
+		return math.MinInt32
+	}
+
+	return node.priority
+}
+
+// The role of the given node. Unknown nodes are treated as observers,
+// so they can never affect an election.
+func (c *Cluster) RoleOf(id Id) Role {
+	node, ok := c.nodes[id]
+
+	if !ok {
+		return RoleObserver
+	}
+
+	return node.role
+}
+
+// The position of a node's priority amongst the distinct priorities of the
+// voters in the cluster, highest first, along with the number of distinct priorities.
+func (c *Cluster) priorityRank(id Id) (rank int, ranks int) {
+	distinct := make(map[int]bool)
+
+	for _, node := range c.nodes {
+		if node.role.canLead() {
+			distinct[node.priority] = true
+		}
+	}
+
+	priority := c.PriorityOf(id)
+
+	for p := range distinct {
+		if p > priority {
+			rank++
+		}
+	}
+
+	return rank, len(distinct)
+}
+
 func (c *Cluster) AddressFor(id Id) (string, error) {
 	node, ok := c.nodes[id]
 
@@ -117,6 +911,28 @@ func (c *Cluster) AddressFor(id Id) (string, error) {
 	return node.udpAddr, nil
 }
 
+// The identity node id's TLS certificate must have.
+func (c *Cluster) identityFor(id Id) (string, error) {
+	node, ok := c.nodes[id]
+
+	if !ok {
+		return "", fmt.Errorf("node %d is not in the cluster", id)
+	}
+
+	return node.identity, nil
+}
+
+// The identity of the node listening on addr, which its TLS certificate must have.
+func (c *Cluster) identityAt(addr string) (string, error) {
+	for _, node := range c.nodes {
+		if node.udpAddr == addr {
+			return node.identity, nil
+		}
+	}
+
+	return "", fmt.Errorf("No node has address %s\n", addr)
+}
+
 func (c *Cluster) HttpAddressFor(id Id) (string, error) {
 	node, ok := c.nodes[id]
 
@@ -128,6 +944,16 @@ func (c *Cluster) HttpAddressFor(id Id) (string, error) {
 }
 
 func ParseConfiguration(config []byte) (Configuration, error) {
+	return parseConfiguration(config, true)
+}
+
+// Parses the configuration of a watchdog with its own Callbacks, for which a command is optional.
+// Any command's stop.gracePeriod still bounds how long the callbacks take to stop leading.
+func ParseEmbeddedConfiguration(config []byte) (Configuration, error) {
+	return parseConfiguration(config, false)
+}
+
+func parseConfiguration(config []byte, commandRequired bool) (Configuration, error) {
 	var raw configurationInput
 	var parsedConfig Configuration
 
@@ -146,21 +972,133 @@ func ParseConfiguration(config []byte) (Configuration, error) {
 	parsedConfig.maxElectionTimeout = msIntToDuration(raw.MaxElectionTimeout)
 	parsedConfig.heartbeatInterval = msIntToDuration(raw.HeartbeatInterval)
 
-	parsedConfig.listenOn, err = net.ResolveUDPAddr("udp", raw.ListenOn)
+	parsedConfig.transport, err = raw.Transport.parse()
 
 	if err != nil {
-		return parsedConfig, fmt.Errorf("Invalid UDP listen udpAddr: %s\n", err.Error())
+		return parsedConfig, err
+	}
+
+	parsedConfig.listenOn = raw.ListenOn
+
+	if err := parsedConfig.transport.resolve(raw.ListenOn); err != nil {
+		return parsedConfig, fmt.Errorf("Invalid %s listenOn address: %s\n", parsedConfig.transport.transport, err.Error())
+	}
+
+	parsedConfig.stateFile = raw.StateFile
+
+	switch recoveryMode(raw.Recovery.Mode) {
+	case "", RecoveryAutomatic:
+		parsedConfig.recovery = RecoveryAutomatic
+	case RecoveryManual:
+		parsedConfig.recovery = RecoveryManual
+	default:
+		return parsedConfig, fmt.Errorf("Unknown recovery mode %q\n", raw.Recovery.Mode)
+	}
+
+	parsedConfig.activationToken = raw.Recovery.ActivationToken
+
+	if parsedConfig.recovery == RecoveryManual && len(parsedConfig.activationToken) == 0 {
+		return parsedConfig, fmt.Errorf("Manual recovery requires an activationToken\n")
+	}
+
+	parsedConfig.membershipToken = raw.Membership.Token
+	parsedConfig.transferToken = raw.Transfer.Token
+
+	parsedConfig.leadershipTimeout = durationOr(raw.LeadershipTimeout, parsedConfig.networkInterval)
+	parsedConfig.leadershipAwareTimeout = durationOr(raw.LeadershipAwareTimeout, parsedConfig.networkInterval)
+	parsedConfig.maxClockDrift = durationOr(raw.MaxClockDrift, time.Second)
+
+	// A message's age is off by as much as the clocks disagree, on top of its time in flight.
+	parsedConfig.auth = authConfig{raw.Auth.KeysFile, durationOr(raw.Auth.MaxAge, parsedConfig.networkInterval+parsedConfig.maxClockDrift)}
+
+	jobInputs := raw.Jobs
+
+	if len(jobInputs) == 0 {
+		// A single command is a single job.
+		jobInputs = []jobInput{{DefaultJob, raw.Command, raw.StateFile}}
+	} else if raw.Command.Name != "" {
+		return parsedConfig, fmt.Errorf("config must contain either a command or jobs, not both\n")
 	}
 
-	parsedConfig.command = Cmd{raw.Command.Name, raw.Command.Args}
+	jobs := make([]Configuration, 0)
+	jobIds := make(map[uint32]string)
+	// Files that two jobs must not share, and which job uses each.
+	files := make(map[string]string)
+
+	for _, input := range jobInputs {
+		job, err := parsedConfig.forJob(input, raw.LeadershipGraceTimeout, len(jobInputs) > 1, commandRequired)
+
+		if err != nil {
+			return parsedConfig, err
+		}
+
+		if other, ok := jobIds[job.jobId]; ok && other == job.job {
+			return parsedConfig, fmt.Errorf("Job %s is configured twice\n", job.job)
+		} else if ok {
+			return parsedConfig, fmt.Errorf("Jobs %s and %s clash; please rename one\n", other, job.job)
+		}
+
+		jobIds[job.jobId] = job.job
+
+		for _, file := range []string{job.stateFile, job.command.logs.dir} {
+			if other, ok := files[file]; ok && file != "" {
+				return parsedConfig, fmt.Errorf("Jobs %s and %s cannot both use %s\n", other, job.job, file)
+			}
+
+			files[file] = job.job
+		}
 
-	if parsedConfig.command.command == "" {
-		return parsedConfig, fmt.Errorf("config did not contain a command")
+		jobs = append(jobs, job)
 	}
 
+	// The configuration is that of the first job, knowing about the rest.
+	parsedConfig = jobs[0]
+	parsedConfig.jobs = jobs
+
 	return parsedConfig, nil
 }
 
+// A copy of this configuration for running the given job. Its state file defaults
+// to ours, with the job name added if there are several jobs.
+func (c Configuration) forJob(input jobInput, graceTimeout uint, several bool, commandRequired bool) (Configuration, error) {
+	if input.Name == "" {
+		return c, fmt.Errorf("A job must have a name\n")
+	}
+
+	// Names end up in file names.
+	for _, r := range input.Name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return c, fmt.Errorf("Job name %q may only contain letters, digits, - and _\n", input.Name)
+		}
+	}
+
+	c.job = input.Name
+	c.jobId = jobId(input.Name)
+	c.jobs = nil
+
+	if input.StateFile != "" {
+		c.stateFile = input.StateFile
+	} else if several && c.stateFile != "" {
+		extension := filepath.Ext(c.stateFile)
+		c.stateFile = strings.TrimSuffix(c.stateFile, extension) + "." + input.Name + extension
+	}
+
+	command, err := input.Command.parse(commandRequired)
+
+	if err != nil {
+		return c, fmt.Errorf("Job %s: %s", input.Name, err.Error())
+	}
+
+	c.command = command
+	c.leadershipGraceTimeout = durationOr(graceTimeout, c.minLeadershipGrace())
+
+	if err := c.validateTimings(); err != nil {
+		return c, fmt.Errorf("Job %s: %s", input.Name, err.Error())
+	}
+
+	return c, nil
+}
+
 func ParseCluster(in []byte) (Cluster, error) {
 	var cluster Cluster
 	var input clusterInput
@@ -171,24 +1109,36 @@ func ParseCluster(in []byte) (Cluster, error) {
 		return cluster, err
 	}
 
+	return newCluster(input.Nodes, 0, input.Preemption)
+}
+
+func newCluster(nodes []nodeInput, version uint64, preemption bool) (Cluster, error) {
+	var cluster Cluster
+
 	cluster.nodes = make(map[Id]Node)
+	cluster.version = version
+	cluster.preemption = preemption
 
-	for _, nodeInput := range input.Nodes {
-		if err = nodeInput.validate(); err != nil {
+	for _, nodeInput := range nodes {
+		if err := nodeInput.validate(); err != nil {
 			return cluster, err
 		}
 
-		var node Node
+		cluster.nodes[Id(nodeInput.Id)] = nodeInput.node()
+	}
+
+	if len(cluster.nodes) == 0 {
+		return cluster, fmt.Errorf("Cluster is invalid. Must specify at least one node.\n")
+	}
 
-		node.id = Id(nodeInput.Id)
-		node.udpAddr = nodeInput.UdpAddr
-		node.httpAddr = nodeInput.HttpAddr
+	hasVoter := false
 
-		cluster.nodes[node.id] = node
+	for _, node := range cluster.nodes {
+		hasVoter = hasVoter || node.role.canLead()
 	}
 
-	if len(cluster.nodes) == 0 {
-		return cluster, fmt.Errorf("Cluster file is invalid. Must specify at least one node.\n")
+	if !hasVoter {
+		return cluster, fmt.Errorf("Cluster is invalid. Must specify at least one voter.\n")
 	}
 
 	return cluster, nil
@@ -197,3 +1147,12 @@ func ParseCluster(in []byte) (Cluster, error) {
 func msIntToDuration(ms uint) time.Duration {
 	return time.Duration(ms * 1e6)
 }
+
+// The given milliseconds as a duration, or the fallback if unset.
+func durationOr(ms uint, fallback time.Duration) time.Duration {
+	if ms == 0 {
+		return fallback
+	}
+
+	return msIntToDuration(ms)
+}
@@ -0,0 +1,237 @@
+package watchdog
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// How the process is executed, beyond its command & arguments.
+// Everything here is validated when the configuration is parsed.
+type execSpec struct {
+	// The environment, as KEY=value, if configured. Otherwise, the
+	// process gets our whole environment.
+	env []string
+	// The names of the variables in env, for reporting. The values may be secret.
+	envNames []string
+	// The working directory. Ours, if empty.
+	dir string
+	// The user & group to run as, as configured, and as IDs. Nil to run as us.
+	user       string
+	group      string
+	credential *syscall.Credential
+	// The umask to start with. Ours, if nil.
+	umask   *int
+	rlimits []rlimit
+}
+
+type rlimit struct {
+	name     string
+	resource int
+	// Both the soft & hard limit.
+	value uint64
+}
+
+// The value of an rlimit that imposes no limit.
+const rlimitUnlimited = math.MaxUint64
+
+func (r rlimit) String() string {
+	if r.value == rlimitUnlimited {
+		return "unlimited"
+	}
+
+	return strconv.FormatUint(r.value, 10)
+}
+
+// The umask & resource limits are per process, so we can't set them for the process without
+// setting them for ourselves too. Instead, the process is started as a copy of ourselves which,
+// seeing this variable, sets them on itself and then executes the command in its place. The
+// variable is removed from the command's environment.
+const execShimVariable = "WATCHDOG_EXEC_SHIM"
+
+// What the copy of ourselves is to do.
+type execShim struct {
+	Path    string      `json:"path"`
+	Umask   *int        `json:"umask,omitempty"`
+	Rlimits []shimLimit `json:"rlimits,omitempty"`
+}
+
+type shimLimit struct {
+	Resource int    `json:"resource"`
+	Value    uint64 `json:"value"`
+}
+
+// Whether commands may be started through this binary, as its main called RunExecShim.
+var execShimEnabled bool
+
+// RunExecShim is for the watchdog's own main, which must call it before anything else. If we
+// were started to set a command's umask & resource limits, it sets them and executes the command
+// in our place, never returning. Otherwise, it lets commands be started through us. Other binaries
+// don't call it, so the variable means nothing to them, and they can't start a command with a
+// umask or resource limits.
+func RunExecShim() {
+	if shim, ok := os.LookupEnv(execShimVariable); ok {
+		err := runExecShim(shim)
+
+		// Only reached if the command could not be executed.
+		fmt.Fprintf(os.Stderr, "watchdog: %s\n", strings.TrimSpace(err.Error()))
+		os.Exit(127)
+	}
+
+	execShimEnabled = true
+}
+
+// Applies the umask & limits to ourselves, and then executes the command in our place.
+func runExecShim(encoded string) error {
+	var shim execShim
+
+	if err := json.Unmarshal([]byte(encoded), &shim); err != nil {
+		return fmt.Errorf("Invalid %s: %s\n", execShimVariable, err.Error())
+	}
+
+	if shim.Umask != nil {
+		syscall.Umask(*shim.Umask)
+	}
+
+	for _, limit := range shim.Rlimits {
+		if err := setRlimit(limit.Resource, limit.Value); err != nil {
+			return fmt.Errorf("Failed to set rlimit %d: %s\n", limit.Resource, err.Error())
+		}
+	}
+
+	env := make([]string, 0)
+
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, execShimVariable+"=") {
+			env = append(env, variable)
+		}
+	}
+
+	return syscall.Exec(shim.Path, os.Args, env)
+}
+
+// The environment the process is started with, before adding our own variables.
+func (e execSpec) environment() []string {
+	if e.env == nil {
+		return os.Environ()
+	}
+
+	return append([]string{}, e.env...)
+}
+
+// Applies the spec to attr, which is otherwise ready to start a process with.
+func (e execSpec) apply(attr *os.ProcAttr) {
+	attr.Dir = e.dir
+
+	if e.credential != nil {
+		if attr.Sys == nil {
+			attr.Sys = new(syscall.SysProcAttr)
+		}
+
+		attr.Sys.Credential = e.credential
+	}
+}
+
+// Starts the process, applying the umask and resource limits before it executes. If
+// they cannot be applied, it exits with status 127 before the command runs.
+func (e execSpec) start(name string, args []string, attr *os.ProcAttr) (*os.Process, error) {
+	e.apply(attr)
+
+	path, env, err := e.shim(name, attr.Env)
+
+	if err != nil {
+		return nil, err
+	}
+
+	attr.Env = env
+
+	return os.StartProcess(path, args, attr)
+}
+
+// Prepares cmd, which is otherwise ready to run, to run with the spec, as the process does.
+func (e execSpec) prepare(cmd *exec.Cmd) error {
+	cmd.Dir = e.dir
+
+	if e.credential != nil {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = new(syscall.SysProcAttr)
+		}
+
+		cmd.SysProcAttr.Credential = e.credential
+	}
+
+	path, env, err := e.shim(cmd.Path, cmd.Env)
+
+	if err != nil {
+		return err
+	}
+
+	cmd.Path, cmd.Env = path, env
+
+	return nil
+}
+
+// What to start, and with what environment, to run name with env under the umask & resource
+// limits. That's name itself if there are none, and otherwise our own binary (see RunExecShim).
+func (e execSpec) shim(name string, env []string) (string, []string, error) {
+	if e.umask == nil && len(e.rlimits) == 0 {
+		return name, env, nil
+	}
+
+	if !execShimEnabled {
+		return "", nil, fmt.Errorf("A umask or rlimits can only be applied by the watchdog's own binary\n")
+	}
+
+	self, err := os.Executable()
+
+	if err != nil {
+		return "", nil, fmt.Errorf("Could not find our own executable, to apply the umask & rlimits: %s\n", err.Error())
+	}
+
+	shim := execShim{name, e.umask, make([]shimLimit, 0)}
+
+	for _, limit := range e.rlimits {
+		shim.Rlimits = append(shim.Rlimits, shimLimit{limit.resource, limit.value})
+	}
+
+	encoded, err := json.Marshal(shim)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if env == nil {
+		env = os.Environ()
+	}
+
+	return self, append(env, execShimVariable+"="+string(encoded)), nil
+}
+
+// How the process is executed, as reported in /state.
+type execReport struct {
+	Env     []string          `json:"env"`
+	Dir     string            `json:"dir"`
+	User    string            `json:"user"`
+	Group   string            `json:"group"`
+	Umask   string            `json:"umask"`
+	Rlimits map[string]string `json:"rlimits"`
+}
+
+func (e execSpec) report() execReport {
+	report := execReport{e.envNames, e.dir, e.user, e.group, "", make(map[string]string)}
+
+	if e.umask != nil {
+		report.Umask = fmt.Sprintf("%04o", *e.umask)
+	}
+
+	for _, limit := range e.rlimits {
+		report.Rlimits[limit.name] = limit.String()
+	}
+
+	return report
+}
@@ -0,0 +1,145 @@
+//go:build linux
+// +build linux
+
+package watchdog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Runs script with spec, returning what it prints.
+func runWithSpec(t *testing.T, spec execSpec, script string) string {
+	sh, err := exec.LookPath("sh")
+
+	if err != nil {
+		t.Skip("sh is needed to report the umask & limits")
+	}
+
+	r, w, err := os.Pipe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	attr := &os.ProcAttr{Env: os.Environ(), Files: []*os.File{nil, w, w}}
+	p, err := spec.start(sh, []string{"sh", "-c", script}, attr)
+	w.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := io.ReadAll(r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := p.Wait()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !state.Success() {
+		t.Fatalf("the command failed (%s): %s", state, output)
+	}
+
+	return string(output)
+}
+
+func TestUmaskAndRlimitsApplyFromTheStart(t *testing.T) {
+	umask := 0027
+	ours := syscall.Umask(0022)
+	syscall.Umask(ours)
+
+	spec := execSpec{umask: &umask, rlimits: []rlimit{{"nofile", syscall.RLIMIT_NOFILE, 100}, {"core", syscall.RLIMIT_CORE, 0}}}
+	output := strings.Fields(runWithSpec(t, spec, "umask; ulimit -n; ulimit -c; env"))
+
+	if len(output) < 3 || output[0] != "0027" || output[1] != "100" || output[2] != "0" {
+		t.Fatalf("expected umask 0027, 100 files and no core dumps, got %v", output)
+	}
+
+	for _, variable := range output[3:] {
+		if strings.HasPrefix(variable, execShimVariable+"=") {
+			t.Fatalf("the command should not see %s", variable)
+		}
+	}
+
+	// Nor should we have been affected.
+	if now := syscall.Umask(ours); now != ours {
+		t.Fatalf("our umask changed from %04o to %04o", ours, now)
+	}
+
+	var limit syscall.Rlimit
+
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+
+	if limit.Cur == 100 {
+		t.Fatal("our own file limit was changed")
+	}
+}
+
+func TestCommandIsStartedDirectlyWithoutUmaskOrRlimits(t *testing.T) {
+	output := runWithSpec(t, execSpec{}, "env")
+
+	if strings.Contains(output, execShimVariable) {
+		t.Fatalf("the command should have been started directly: %s", output)
+	}
+}
+
+func TestOnlyTheWatchdogBinaryAppliesUmaskOrRlimits(t *testing.T) {
+	execShimEnabled = false
+	defer func() { execShimEnabled = true }()
+
+	umask := 0027
+	spec := execSpec{umask: &umask}
+
+	if _, err := spec.start("/bin/true", []string{"true"}, &os.ProcAttr{}); err == nil {
+		t.Fatal("the command was started without RunExecShim having been called")
+	}
+}
+
+func TestHooksRunWithTheExecSpec(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+
+	if err != nil {
+		t.Skip("sh is needed for the hook")
+	}
+
+	dir := t.TempDir()
+	umask := 0027
+	limits := []rlimit{{"nofile", syscall.RLIMIT_NOFILE, 100}}
+	spec := execSpec{env: []string{"PATH=" + os.Getenv("PATH"), "STAGE=pre-start"}, dir: dir, umask: &umask, rlimits: limits}
+
+	h := hook{sh, []string{"sh", "-c", `echo "$STAGE $WATCHDOG_FENCING_TOKEN $(pwd) $(umask) $(ulimit -n) ${HOME:-nohome}" > hook.out`}, 5 * time.Second}
+
+	if err := runHook(h, spec, FencingToken{3, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := os.ReadFile(filepath.Join(dir, "hook.out"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the configured environment, along with the fencing token's.
+	expected := fmt.Sprintf("pre-start %s %s 0027 100 nohome", FencingToken{3, 1}, dir)
+
+	if got := strings.TrimSpace(string(output)); got != expected {
+		t.Fatalf("the hook saw %q, expected %q", got, expected)
+	}
+}
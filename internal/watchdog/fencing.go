@@ -0,0 +1,95 @@
+package watchdog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Environment variables through which the managed process
+// learns about the leadership it is running under.
+const (
+	EnvNodeId       = "WATCHDOG_NODE_ID"
+	EnvTerm         = "WATCHDOG_TERM"
+	EnvFencingToken = "WATCHDOG_FENCING_TOKEN"
+)
+
+// FencingToken identifies a single leadership: the node that won
+// an election and the term it won it in. Terms only ever increase
+// between leaderships, so downstream systems can remember the latest
+// token they have seen and reject anything older. This stops a deposed
+// leader (e.g. one that was paused) from writing after a failover.
+type FencingToken struct {
+	Term uint64
+	Node Id
+}
+
+func (t FencingToken) String() string {
+	return fmt.Sprintf("%d-%d", t.Term, t.Node)
+}
+
+// IsStale reports whether this token belongs to an older leadership than latest.
+// A token for the same term is only accepted from the same node, as at most
+// one node can lead in any given term.
+func (t FencingToken) IsStale(latest FencingToken) bool {
+	if t.Term != latest.Term {
+		return t.Term < latest.Term
+	}
+
+	return t.Node != latest.Node
+}
+
+// Parses a token in the format produced by FencingToken.String.
+func ParseFencingToken(in string) (FencingToken, error) {
+	var token FencingToken
+
+	parts := strings.Split(in, "-")
+
+	if len(parts) != 2 {
+		return token, fmt.Errorf("Malformed fencing token %q\n", in)
+	}
+
+	term, err := strconv.ParseUint(parts[0], 10, 64)
+
+	if err != nil {
+		return token, fmt.Errorf("Invalid term in fencing token %q: %s\n", in, err.Error())
+	}
+
+	node, err := strconv.ParseUint(parts[1], 10, 16)
+
+	if err != nil || node == uint64(NullId) {
+		return token, fmt.Errorf("Invalid node in fencing token %q\n", in)
+	}
+
+	token.Term = term
+	token.Node = Id(node)
+
+	return token, nil
+}
+
+// Replaces leadership placeholders in the process arguments.
+// Supported placeholders are {nodeId}, {term} and {fencingToken}.
+func (t FencingToken) expandArgs(args []string) []string {
+	replacer := strings.NewReplacer(
+		"{nodeId}", strconv.Itoa(int(t.Node)),
+		"{term}", strconv.FormatUint(t.Term, 10),
+		"{fencingToken}", t.String(),
+	)
+
+	expanded := make([]string, len(args))
+
+	for i, arg := range args {
+		expanded[i] = replacer.Replace(arg)
+	}
+
+	return expanded
+}
+
+// The environment variables describing this token, in os.Environ format.
+func (t FencingToken) environment() []string {
+	return []string{
+		fmt.Sprintf("%s=%d", EnvNodeId, t.Node),
+		fmt.Sprintf("%s=%d", EnvTerm, t.Term),
+		fmt.Sprintf("%s=%s", EnvFencingToken, t.String()),
+	}
+}
@@ -0,0 +1,187 @@
+package watchdog
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Hooks are commands run around the process, to acquire local resources it needs
+// (e.g. mounting its state, or fetching the latest checkpoint) and release them after.
+//
+// Pre-start hooks run once per leadership, before the process is first started.
+// If any fails, we step down rather than run the process without its resources.
+// Post-stop hooks run once the process has stopped for good (we're no longer
+// leading, or are handing over), and must finish before we hand over leadership.
+// Each set runs in order, stopping at the first failure.
+//
+// Hooks (and exec probes) run as the process does, with its exec settings: its
+// environment, working directory, user & group, umask and resource limits.
+type hook struct {
+	command string
+	args    []string
+	timeout time.Duration
+}
+
+type hooksConfig struct {
+	preStart []hook
+	postStop []hook
+}
+
+// The longest the post-stop hooks can take between them.
+func (h hooksConfig) maxPostStop() time.Duration {
+	var total time.Duration
+
+	for _, hook := range h.postStop {
+		total += hook.timeout
+	}
+
+	return total
+}
+
+type hookState struct {
+	mu sync.Mutex
+	// The leadership that pre-start hooks have acquired resources for, until post-stop hooks release them.
+	acquired *FencingToken
+	// A leadership whose pre-start hooks failed. They are not retried.
+	failed *FencingToken
+}
+
+// Runs the pre-start hooks for the leadership, if not already done. Reports whether
+// the process may be started. Resources held for an older leadership are released first.
+func (w *Watchdog) acquireResources(token FencingToken) bool {
+	w.hooks.mu.Lock()
+	acquired, failed := w.hooks.acquired, w.hooks.failed
+	w.hooks.mu.Unlock()
+
+	if acquired != nil && *acquired == token {
+		return true
+	}
+
+	if failed != nil && *failed == token {
+		return false
+	}
+
+	w.releaseResources()
+
+	if err := w.runHooks("pre-start", w.config.command.hooks.preStart, token); err != nil {
+		w.hooks.mu.Lock()
+		w.hooks.failed = &token
+		w.hooks.mu.Unlock()
+
+		w.timers.sync(func() {
+			if w.currentTerm == token.Term {
+				w.stepDown("pre-start hooks failed")
+			}
+		})
+
+		return false
+	}
+
+	w.hooks.mu.Lock()
+	w.hooks.acquired = &token
+	w.hooks.mu.Unlock()
+
+	return true
+}
+
+// Runs the post-stop hooks, if resources are held. The process must have stopped.
+func (w *Watchdog) releaseResources() {
+	w.hooks.mu.Lock()
+	acquired := w.hooks.acquired
+	w.hooks.mu.Unlock()
+
+	if acquired == nil {
+		return
+	}
+
+	// Whether or not they succeed, there's nothing more we can do.
+	_ = w.runHooks("post-stop", w.config.command.hooks.postStop, *acquired)
+
+	w.hooks.mu.Lock()
+	w.hooks.acquired = nil
+	w.hooks.mu.Unlock()
+}
+
+func (w *Watchdog) runHooks(stage string, hooks []hook, token FencingToken) error {
+	for _, h := range hooks {
+		started := time.Now()
+		err := runHook(h, w.config.command.exec, token)
+
+		var message string
+
+		if err != nil {
+			message = fmt.Sprintf("%s hook %s failed: %s", stage, h.command, err.Error())
+		} else {
+			message = fmt.Sprintf("%s hook %s succeeded in %s", stage, h.command, time.Since(started).Round(time.Millisecond))
+		}
+
+		w.timers.sync(func() {
+			w.event(message)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Runs a hook to completion with spec, killing it (and anything it started) if it takes too long.
+func runHook(h hook, spec execSpec, token FencingToken) error {
+	var output bytes.Buffer
+
+	cmd := &exec.Cmd{
+		Path:        h.command,
+		Args:        token.expandArgs(h.args),
+		Env:         append(spec.environment(), token.environment()...),
+		Stdout:      &output,
+		Stderr:      &output,
+		SysProcAttr: groupAttributes(),
+	}
+
+	if len(cmd.Args) == 0 {
+		cmd.Args = []string{h.command}
+	}
+
+	if err := spec.prepare(cmd); err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	timeout := time.AfterFunc(h.timeout, func() {
+		_ = signalGroup(cmd.Process.Pid, syscall.SIGKILL)
+	})
+
+	err := cmd.Wait()
+
+	if !timeout.Stop() {
+		return fmt.Errorf("timed out after %s", h.timeout)
+	}
+
+	// Don't leave anything it started behind.
+	_ = signalGroup(cmd.Process.Pid, syscall.SIGKILL)
+
+	if err != nil {
+		if last := lastLine(output.Bytes()); len(last) > 0 {
+			return fmt.Errorf("%s: %s", err.Error(), last)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func lastLine(output []byte) []byte {
+	lines := bytes.Split(bytes.TrimSpace(output), []byte("\n"))
+
+	return lines[len(lines)-1]
+}
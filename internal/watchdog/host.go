@@ -0,0 +1,260 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A Host runs every configured job on this node. Each job is elected independently,
+// with its own term, votes, timers and process, as if by its own Watchdog (which it is).
+// They share a single Transport, with each message tagged with the job it is for.
+//
+// Leaders are spread across the cluster where possible. A node waits longer before
+// standing for election for each job it already leads, so less loaded nodes win first.
+// And a leader hands a job over to a healthy follower that leads at least two fewer jobs.
+// Priorities still come first: a node will not take a job from a preferred node.
+type Host struct {
+	id      Id
+	jobs    []*Watchdog
+	adapter *adapter
+
+	mu sync.Mutex
+	// We only move one job at a time, and not again until it has settled.
+	rebalanceAfter time.Time
+	// Where each job's election stands, as it last told us. Jobs read each other's
+	// election through this, as they may only touch their own on their own queue.
+	standings map[*Watchdog]standing
+
+	shutdownOnce sync.Once
+	stopped      chan struct{}
+
+	Errors chan error
+	Info   chan []byte
+}
+
+func NewHost(id Id, config Configuration, cluster Cluster) *Host {
+	h := Host{
+		id:      id,
+		stopped: make(chan struct{}),
+		standings: make(map[*Watchdog]standing),
+		Errors:  make(chan error),
+		Info:   make(chan []byte),
+	}
+
+	for _, job := range config.Jobs() {
+		w := NewWatchdog(id, job, cluster)
+
+		w.host = &h
+		w.Errors = h.Errors
+		w.Info = h.Info
+
+		h.jobs = append(h.jobs, w)
+	}
+
+	// Blacklisting is per node, but each job has its own membership.
+	h.adapter = makeAdapter()
+
+	for _, w := range h.jobs {
+		w.adapter = h.adapter
+		w.adapter.nodes.update(w.config.jobId, w.cluster)
+	}
+
+	return &h
+}
+
+// Starts every job, until ctx is done or Shutdown is called.
+func (h *Host) Start(ctx context.Context) error {
+	if err := h.adapter.prepare(h.jobs[0].id, h.jobs[0].config, realClock{}); err != nil {
+		return err
+	}
+
+	for _, w := range h.jobs {
+		if err := w.Start(ctx); err != nil {
+			_ = h.Shutdown(context.Background())
+			return fmt.Errorf("Could not start job %s: %s", w.config.job, err.Error())
+		}
+	}
+
+	// Every job listens on the same address.
+	if err := h.adapter.listen(h.jobs[0].config.listenOn, h.handleMessage, h.error); err != nil {
+		_ = h.Shutdown(context.Background())
+		return err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = h.Shutdown(context.Background())
+		case <-h.stopped:
+		}
+	}()
+
+	return nil
+}
+
+// Shuts every job down, together, and then stops listening. See Watchdog.Shutdown.
+func (h *Host) Shutdown(ctx context.Context) error {
+	h.shutdownOnce.Do(func() {
+		go func() {
+			defer close(h.stopped)
+
+			var jobs sync.WaitGroup
+
+			for _, w := range h.jobs {
+				jobs.Add(1)
+
+				go func(w *Watchdog) {
+					defer jobs.Done()
+
+					_ = w.Shutdown(context.Background())
+				}(w)
+			}
+
+			jobs.Wait()
+
+			if err := h.adapter.close(); err != nil {
+				h.error(err)
+			}
+		}()
+	})
+
+	select {
+	case <-h.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Closed once every job has shut down.
+func (h *Host) Done() <-chan struct{} {
+	return h.stopped
+}
+
+// The jobs run by this host, in the order configured.
+func (h *Host) Jobs() []*Watchdog {
+	return h.jobs
+}
+
+// The named job, or nil if there is no such job.
+func (h *Host) Job(name string) *Watchdog {
+	for _, w := range h.jobs {
+		if w.config.job == name {
+			return w
+		}
+	}
+
+	return nil
+}
+
+func (h *Host) handleMessage(m message) {
+	for _, w := range h.jobs {
+		if w.config.jobId == m.job {
+			w.handleMessage(m)
+			return
+		}
+	}
+
+	h.error(fmt.Errorf("NET: Ignoring message (%s) for an unknown job\n", m.String()))
+}
+
+func (h *Host) error(err error) {
+	go func() {
+		select {
+		case h.Errors <- err:
+		case <-h.stopped:
+		}
+	}()
+}
+
+type standing struct {
+	leading bool
+	leader  Id
+}
+
+// Records where w's election stands. Called on w's queue whenever that changes.
+func (h *Host) observe(w *Watchdog) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.standings[w] = standing{w.state == StateLeading, w.leader}
+}
+
+// How many jobs each node leads, as far as this node knows. Only nodes leading something
+// are included. h.mu must be held.
+func (h *Host) leaderships() map[Id]int {
+	counts := make(map[Id]int)
+
+	for _, standing := range h.standings {
+		if !standing.leader.IsNull() {
+			counts[standing.leader]++
+		}
+	}
+
+	return counts
+}
+
+// How many jobs, other than w, this node leads.
+func (h *Host) otherLeaderships(w *Watchdog) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	count := 0
+
+	for job, standing := range h.standings {
+		if job != w && standing.leading {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Whether any node that can lead has a higher priority than id.
+func outranked(cluster Cluster, id Id) bool {
+	for other, node := range cluster.nodes {
+		if other != id && node.role.canLead() && node.priority > cluster.PriorityOf(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The follower that w, which is leading, should hand its job to so that leaders are
+// spread more evenly, or NullId if there isn't one. At most one job moves at a time.
+func (h *Host) rebalanceTarget(w *Watchdog) Id {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if w.clock.Now().Before(h.rebalanceAfter) {
+		return NullId
+	}
+
+	counts := h.leaderships()
+	target := NullId
+
+	for id, seen := range w.followerSeen {
+		if id == w.id || !w.cluster.RoleOf(id).canLead() || w.clock.Now().Sub(seen) > w.config.networkInterval {
+			continue
+		}
+
+		if outranked(w.cluster, id) {
+			// Voters would refuse it, preferring a node of a higher priority.
+			continue
+		}
+
+		if counts[id] <= counts[w.id]-2 && (target.IsNull() || counts[id] < counts[target]) {
+			target = id
+		}
+	}
+
+	if !target.IsNull() {
+		// Allow for the transfer, and for the target to settle in as leader.
+		h.rebalanceAfter = w.clock.Now().Add(w.config.command.stop.gracePeriod + w.config.command.hooks.maxPostStop() + w.config.leadershipGraceTimeout + 2*w.config.networkInterval)
+	}
+
+	return target
+}
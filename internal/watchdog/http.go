@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"single-executor/internal/util"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,7 +22,7 @@ type httpMonitor struct {
 type watchdogReportEvent struct {
 	Node  Id        `json:"nodeId"`
 	Event string    `json:"event"`
-	Term  uint8     `json:"term"`
+	Term  uint64    `json:"term"`
 	Time  time.Time `json:"time"`
 }
 
@@ -40,13 +42,39 @@ func (s sortableEvents) Swap(i, j int) {
 
 type watchdogReport struct {
 	Id             Id       `json:"id"`
+	Role           Role     `json:"role"`
 	State          string   `json:"state"`
+	SubState       string   `json:"subState"`
 	Leader         Id       `json:"leader"`
 	VotedFor       Id       `json:"votedFor"`
-	CurrentTerm    uint8    `json:"currentTerm"`
+	CurrentTerm    uint64   `json:"currentTerm"`
 	Blacklist      []int    `json:"blacklist"`
 	Events         sortableEvents `json:"events"`
 	RunningProcess string   `json:"process"`
+	FencingToken   string   `json:"fencingToken"`
+	ProcessState   processState `json:"processState"`
+	Membership     watchdogMembershipReport `json:"membership"`
+	Exec           execReport `json:"exec"`
+	Job            string   `json:"job"`
+	Auth           authReport `json:"auth"`
+	// Every job's report, when reporting for a host. The top level is the first job's.
+	Jobs           []watchdogReport `json:"jobs,omitempty"`
+}
+
+// How many messages have been dropped by message authentication, if enabled.
+type authReport struct {
+	Enabled         bool   `json:"enabled"`
+	Unauthenticated uint64 `json:"unauthenticated"`
+	Replayed        uint64 `json:"replayed"`
+}
+
+type watchdogMembershipReport struct {
+	Version uint64      `json:"version"`
+	Nodes   []nodeInput `json:"nodes"`
+	// Whether the leader is still waiting for a majority to acknowledge this version.
+	Pending bool        `json:"pending"`
+	// The nodes that have acknowledged it, if pending.
+	Acked   []int       `json:"acked"`
 }
 
 func (h httpMonitor) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
@@ -70,24 +98,313 @@ func (h httpMonitor) ServeHTTP(writer http.ResponseWriter, request *http.Request
 		} else {
 			h.whitelist(writer, Id(id))
 		}
+	case "/transfer":
+		h.transfer(writer, request)
+	case "/activate":
+		h.activate(writer, request)
+	case "/membership/add":
+		h.addNode(writer, request)
+	case "/membership/remove":
+		h.removeNode(writer, request)
+	case "/process/logs":
+		h.processLogs(writer, request)
 	default:
 		http.NotFound(writer, request)
 	}
 }
 
+// Activates a leader awaiting manual activation. Must be a POST with
+// the configured token, as "Authorization: Bearer <token>". An optional
+// term query parameter restricts activation to that term.
+func (h *httpMonitor) activate(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Must POST to activate", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	if !h.w.isActivationToken(token) {
+		http.Error(writer, "Invalid activation token", http.StatusUnauthorized)
+		return
+	}
+
+	var term uint64
+
+	if termInput := request.URL.Query().Get("term"); termInput != "" {
+		var err error
+
+		if term, err = strconv.ParseUint(termInput, 10, 64); err != nil {
+			http.Error(writer, "Must provide a numeric term", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.w.Activate(term); err != nil {
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writer.WriteHeader(200)
+}
+
+// Whether the request may change membership: a POST with the configured membership
+// token, as "Authorization: Bearer <token>". If not, the response has been written.
+func (h *httpMonitor) canChangeMembership(writer http.ResponseWriter, request *http.Request) bool {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Must POST to change membership", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	if !h.w.isMembershipToken(token) {
+		http.Error(writer, "Invalid membership token", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// Adds a node to the cluster. Must be a POST to the leader with the membership token, and
+// the node's id, udpAddr, httpAddr and optionally role & priority as query parameters.
+func (h *httpMonitor) addNode(writer http.ResponseWriter, request *http.Request) {
+	if !h.canChangeMembership(writer, request) {
+		return
+	}
+
+	query := request.URL.Query()
+
+	id, err := strconv.ParseUint(query.Get("id"), 10, 16)
+
+	if err != nil {
+		http.Error(writer, "Must provide a numeric ID", http.StatusBadRequest)
+		return
+	}
+
+	priority := 0
+
+	if priorityInput := query.Get("priority"); priorityInput != "" {
+		if priority, err = strconv.Atoi(priorityInput); err != nil {
+			http.Error(writer, "Must provide a numeric priority", http.StatusBadRequest)
+			return
+		}
+	}
+
+	node, err := NewNode(Id(id), query.Get("udpAddr"), query.Get("httpAddr"), Role(query.Get("role")), priority, query.Get("identity"))
+
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.w.AddNode(node); err != nil {
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writer.WriteHeader(200)
+}
+
+// Removes a node from the cluster. Must be a POST to the leader with the membership token and the node's id.
+func (h *httpMonitor) removeNode(writer http.ResponseWriter, request *http.Request) {
+	if !h.canChangeMembership(writer, request) {
+		return
+	}
+
+	id, err := strconv.ParseUint(request.URL.Query().Get("id"), 10, 16)
+
+	if err != nil {
+		http.Error(writer, "Must provide a numeric ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.w.RemoveNode(Id(id)); err != nil {
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writer.WriteHeader(200)
+}
+
+// Returns the last lines of the process' output, as plain text. Query parameters:
+// stream (stdout or stderr, the default is stdout), tail (the number of lines, 100
+// by default) and follow, which streams new lines as server-sent events instead.
+func (h *httpMonitor) processLogs(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+
+	stream := StreamStdout
+
+	if streamInput := query.Get("stream"); streamInput != "" {
+		stream = logStream(streamInput)
+	}
+
+	output, ok := h.w.logs[stream]
+
+	if !ok {
+		http.Error(writer, "Process output is not captured, or unknown stream", http.StatusNotFound)
+		return
+	}
+
+	tail := 100
+
+	if query.Get("tail") != "" {
+		var err error
+
+		if tail, err = util.GetIntParam("tail", query); err != nil || tail < 0 {
+			http.Error(writer, "Must provide a non-negative numeric tail", http.StatusBadRequest)
+			return
+		}
+	}
+
+	follow := query.Get("follow") == "true" || query.Get("follow") == "1"
+
+	var listener chan []byte
+
+	if follow {
+		// Listen before reading the tail, so we don't miss anything in between.
+		listener = output.listen()
+	}
+
+	lines, err := output.tail(tail)
+
+	if err != nil {
+		if follow {
+			output.detach(listener)
+		}
+
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+
+	if !follow {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.WriteHeader(200)
+
+		for _, line := range lines {
+			if _, err := fmt.Fprintf(writer, "%s\n", line); err != nil {
+				return
+			}
+		}
+
+		return
+	}
+
+	messages, done, serve := util.HandleSse(writer, request)
+
+	go func() {
+		defer output.detach(listener)
+
+		for _, line := range lines {
+			select {
+			case messages <- line:
+			case <-done:
+				return
+			}
+		}
+
+		for {
+			select {
+			case line := <-listener:
+				select {
+				case messages <- line:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	serve()
+}
+
+// Transfers leadership away from the leader. Must be a POST with the configured transfer
+// token, as "Authorization: Bearer <token>", and either a node's id or "any" (the default).
+func (h *httpMonitor) transfer(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Must POST to transfer leadership", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	if !h.w.isTransferToken(token) {
+		http.Error(writer, "Invalid transfer token", http.StatusUnauthorized)
+		return
+	}
+
+	id := NullId
+
+	if idInput := request.URL.Query().Get("id"); idInput != "" && idInput != "any" {
+		parsed, err := strconv.Atoi(idInput)
+
+		if err != nil {
+			http.Error(writer, "Must provide a numeric ID or any", http.StatusBadRequest)
+			return
+		}
+
+		id = Id(parsed)
+	}
+
+	if err := h.w.TransferLeadership(id); err != nil {
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writer.WriteHeader(200)
+}
+
 func (h *httpMonitor) blacklist(writer http.ResponseWriter, id Id) {
 	h.w.adapter.blacklistNode(id)
-	h.w.event(fmt.Sprintf("blacklist node %d", id))
+	h.w.timers.sync(func() { h.w.event(fmt.Sprintf("blacklist node %d", id)) })
 	writer.WriteHeader(200)
 }
 
 func (h *httpMonitor) whitelist(writer http.ResponseWriter, id Id) {
 	h.w.adapter.whitelistNode(id)
-	h.w.event(fmt.Sprintf("blacklist node %d", id))
+	h.w.timers.sync(func() { h.w.event(fmt.Sprintf("whitelist node %d", id)) })
 	writer.WriteHeader(200)
 }
 
 func (h *httpMonitor) reportState(writer http.ResponseWriter) {
+	report, ok := h.report()
+
+	if !ok {
+		http.Error(writer, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	writeReport(writer, report)
+}
+
+// Reports the election's state, read on the queue that changes it. False once shut down.
+func (h *httpMonitor) report() (watchdogReport, bool) {
+	result := make(chan watchdogReport, 1)
+
+	if !h.w.timers.sync(func() { result <- h.electionReport() }) {
+		return watchdogReport{}, false
+	}
+
+	report := <-result
+
+	if auth := h.w.adapter.auth; auth != nil {
+		report.Auth.Enabled = true
+		report.Auth.Unauthenticated, report.Auth.Replayed = auth.dropped()
+	}
+
+	if h.w.isProcessRunning() {
+		report.RunningProcess = h.w.config.command.command
+		token, _ := h.w.supervisor.runningToken()
+		report.FencingToken = token.String()
+	}
+
+	return report, true
+}
+
+// Must be called from the queue.
+func (h *httpMonitor) electionReport() watchdogReport {
 	events := make(sortableEvents, 0)
 
 	for timestamp, event := range h.w.events {
@@ -103,25 +420,32 @@ func (h *httpMonitor) reportState(writer http.ResponseWriter) {
 
 	blacklist := make([]int, 0)
 
-	for _, id := range h.w.adapter.blacklist {
+	for _, id := range h.w.adapter.blacklisted() {
 		blacklist = append(blacklist, int(id))
 	}
 
-	report := watchdogReport{
+	return watchdogReport{
 		h.w.id,
+		h.w.cluster.RoleOf(h.w.id),
 		h.w.state.String(),
+		h.w.subState(),
 		h.w.leader,
 		h.w.votedFor,
 		h.w.currentTerm,
 		blacklist,
 		events,
 		"",
+		"",
+		h.w.supervisor.state(),
+		h.membershipReport(),
+		h.w.config.command.exec.report(),
+		h.w.config.job,
+		authReport{},
+		nil,
 	}
+}
 
-	if h.w.isProcessRunning() {
-		report.RunningProcess = h.w.config.command.command
-	}
-
+func writeReport(writer http.ResponseWriter, report watchdogReport) {
 	data, err := json.Marshal(report)
 
 	if err != nil {
@@ -138,8 +462,75 @@ func (h *httpMonitor) reportState(writer http.ResponseWriter) {
 	}
 }
 
-func HttpMonitor(w *Watchdog) error {
-	monitor := httpMonitor{w}
+// Must be called from the queue.
+func (h *httpMonitor) membershipReport() watchdogMembershipReport {
+	record := h.w.cluster.record()
+
+	report := watchdogMembershipReport{record.Version, record.Nodes, false, make([]int, 0)}
+
+	if pending := h.w.pendingMembership; pending != nil {
+		report.Pending = true
+
+		for id, version := range pending.acks {
+			if version >= record.Version {
+				report.Acked = append(report.Acked, int(id))
+			}
+		}
+
+		sort.Ints(report.Acked)
+	}
+
+	return report
+}
+
+// Monitors each of a host's jobs. Requests are for the job given by the job query
+// parameter, or the first job if not given. /state reports every job.
+type hostMonitor struct {
+	h *Host
+}
+
+func (m hostMonitor) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	w := m.h.jobs[0]
+
+	if name := request.URL.Query().Get("job"); name != "" {
+		if w = m.h.Job(name); w == nil {
+			http.Error(writer, fmt.Sprintf("Unknown job %s", name), http.StatusNotFound)
+			return
+		}
+	}
+
+	if request.URL.Path == "/state" && request.URL.Query().Get("job") == "" {
+		m.reportState(writer)
+		return
+	}
+
+	httpMonitor{w}.ServeHTTP(writer, request)
+}
+
+func (m hostMonitor) reportState(writer http.ResponseWriter) {
+	jobs := make([]watchdogReport, 0)
+
+	for _, w := range m.h.jobs {
+		monitor := httpMonitor{w}
+		report, ok := monitor.report()
+
+		if !ok {
+			http.Error(writer, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		jobs = append(jobs, report)
+	}
+
+	// The first job at the top level, as if it were the only one.
+	report := jobs[0]
+	report.Jobs = jobs
+
+	writeReport(writer, report)
+}
+
+func HttpMonitor(h *Host) error {
+	monitor := hostMonitor{h}
 
 	err := http.ListenAndServe("0.0.0.0:80", monitor)
 
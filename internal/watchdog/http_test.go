@@ -0,0 +1,140 @@
+package watchdog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMembershipChangesNeedTheToken(t *testing.T) {
+	for _, configured := range []string{"", "secret"} {
+		w := &Watchdog{config: Configuration{membershipToken: configured}}
+
+		for _, path := range []string{"/membership/add?id=6&udpAddr=node6:6000&httpAddr=http://node6", "/membership/remove?id=2"} {
+			for _, token := range []string{"", "wrong", "secret "} {
+				request := httptest.NewRequest(http.MethodPost, path, nil)
+
+				if token != "" {
+					request.Header.Set("Authorization", "Bearer "+token)
+				}
+
+				response := httptest.NewRecorder()
+				httpMonitor{w}.ServeHTTP(response, request)
+
+				if response.Code != http.StatusUnauthorized {
+					t.Errorf("%s with token %q (configured %q) got %d, expected %d", path, token, configured, response.Code, http.StatusUnauthorized)
+				}
+			}
+		}
+	}
+}
+
+func TestTransferNeedsAPostWithTheToken(t *testing.T) {
+	for _, configured := range []string{"", "secret"} {
+		w := &Watchdog{config: Configuration{transferToken: configured}}
+
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			for _, token := range []string{"", "wrong", "secret "} {
+				request := httptest.NewRequest(method, "/transfer?id=any", nil)
+
+				if token != "" {
+					request.Header.Set("Authorization", "Bearer "+token)
+				}
+
+				response := httptest.NewRecorder()
+				httpMonitor{w}.ServeHTTP(response, request)
+
+				expected := http.StatusUnauthorized
+
+				if method == http.MethodGet {
+					expected = http.StatusMethodNotAllowed
+				}
+
+				if response.Code != expected {
+					t.Errorf("%s with token %q (configured %q) got %d, expected %d", method, token, configured, response.Code, expected)
+				}
+			}
+		}
+
+		// Even with the right token, a GET (e.g. a link followed by a crawler) must not move leadership.
+		request := httptest.NewRequest(http.MethodGet, "/transfer?id=any", nil)
+		request.Header.Set("Authorization", "Bearer "+configured)
+		response := httptest.NewRecorder()
+		httpMonitor{w}.ServeHTTP(response, request)
+
+		if response.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET with the configured token %q got %d, expected %d", configured, response.Code, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// Run with -race: the report must be read on the queue, not alongside the elections changing it.
+func TestStateCanBeReportedDuringElections(t *testing.T) {
+	addrs := freeUDPAddrs(t, 3)
+	cluster := leakTestCluster(t, addrs)
+
+	callbacks := blockingCallbacks{make(chan struct{}, 1)}
+	nodes := make([]*Watchdog, 0)
+
+	for i, addr := range addrs {
+		w := NewWatchdogWithCallbacks(Id(i+1), leakTestConfig(t, addr, "command:\n  stop:\n    gracePeriod: 100\n"), cluster, callbacks)
+
+		if err := w.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		nodes = append(nodes, w)
+	}
+
+	done := make(chan struct{})
+	var polling sync.WaitGroup
+
+	for _, w := range nodes {
+		polling.Add(1)
+
+		go func(w *Watchdog) {
+			defer polling.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				response := httptest.NewRecorder()
+				httpMonitor{w}.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/state", nil))
+
+				if response.Code == http.StatusOK {
+					var report watchdogReport
+
+					if err := json.Unmarshal(response.Body.Bytes(), &report); err != nil {
+						t.Error(err)
+					}
+				}
+
+				time.Sleep(5 * time.Millisecond)
+			}
+		}(w)
+	}
+
+	select {
+	case <-callbacks.started:
+	case <-time.After(5 * time.Second):
+		t.Error("no node started leading")
+	}
+
+	// Still polling while they shut down, when the report is unavailable.
+	for _, w := range nodes {
+		if err := w.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(done)
+	polling.Wait()
+}
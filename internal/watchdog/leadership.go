@@ -0,0 +1,193 @@
+package watchdog
+
+import (
+	"context"
+	"sync"
+)
+
+// Callbacks are how the elected leader does its work, and how everyone else
+// hears about it. Running the configured command is one implementation.
+type Callbacks interface {
+	// Called when this node may start working as leader. ctx is cancelled when it
+	// loses leadership (or is handing it over), and the work must have stopped
+	// before this returns. It is called once per leadership, whose fencing token is
+	// in ctx (see FencingTokenFrom), or again if a handover is called off.
+	OnStartedLeading(ctx context.Context)
+	// Called once OnStartedLeading has returned after losing leadership.
+	OnStoppedLeading()
+	// Called when a different leader (possibly us) is seen. This should return quickly.
+	OnNewLeader(id Id)
+}
+
+// Callbacks may also report whether their work is ready, once started. If not, it always is.
+type readiness interface {
+	ready() bool
+}
+
+type fencingTokenKey struct{}
+
+// The fencing token of the leadership that ctx, as given to OnStartedLeading, belongs to.
+func FencingTokenFrom(ctx context.Context) (FencingToken, bool) {
+	token, ok := ctx.Value(fencingTokenKey{}).(FencingToken)
+
+	return token, ok
+}
+
+// A call to OnStartedLeading, from when it is made until OnStoppedLeading.
+type leadership struct {
+	token  FencingToken
+	cancel context.CancelFunc
+	// Whether we've asked it to stop.
+	cancelled bool
+	// Closed when OnStartedLeading returns.
+	done chan struct{}
+}
+
+type leadershipState struct {
+	mu      sync.Mutex
+	current *leadership
+	// The last leader passed to OnNewLeader.
+	leader Id
+}
+
+// Starts working as leader under token, unless we already have for this leadership.
+// If still working under an older one, that is stopped first.
+func (w *Watchdog) startLeading(token FencingToken) {
+	w.leadership.mu.Lock()
+	current := w.leadership.current
+	w.leadership.mu.Unlock()
+
+	if current != nil && current.token == token && !current.cancelled {
+		return
+	}
+
+	if current != nil {
+		// We'll start once that's stopped.
+		w.stopLeading()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), fencingTokenKey{}, token))
+	current = &leadership{token, cancel, false, make(chan struct{})}
+
+	w.leadership.mu.Lock()
+	w.leadership.current = current
+	w.leadership.mu.Unlock()
+
+	go func() {
+		defer close(current.done)
+
+		w.callbacks.OnStartedLeading(ctx)
+	}()
+}
+
+// Asks any work as leader to stop, and calls OnStoppedLeading once it has.
+func (w *Watchdog) stopLeading() {
+	w.leadership.mu.Lock()
+	current := w.leadership.current
+
+	if current != nil {
+		current.cancelled = true
+	}
+
+	w.leadership.mu.Unlock()
+
+	if current == nil {
+		return
+	}
+
+	current.cancel()
+
+	select {
+	case <-current.done:
+	default:
+		// Still stopping.
+		return
+	}
+
+	w.leadership.mu.Lock()
+	w.leadership.current = nil
+	w.leadership.mu.Unlock()
+
+	w.callbacks.OnStoppedLeading()
+}
+
+// Whether OnStoppedLeading is yet to be called for some leadership.
+func (w *Watchdog) hasLeadership() bool {
+	w.leadership.mu.Lock()
+	defer w.leadership.mu.Unlock()
+
+	return w.leadership.current != nil
+}
+
+// Whether we are still working as leader, i.e. OnStartedLeading has not returned.
+func (w *Watchdog) isLeadingActive() bool {
+	w.leadership.mu.Lock()
+	defer w.leadership.mu.Unlock()
+
+	if w.leadership.current == nil {
+		return false
+	}
+
+	select {
+	case <-w.leadership.current.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Calls OnNewLeader if the leader has changed since we last did.
+func (w *Watchdog) observeLeader(leader Id) {
+	if leader.IsNull() || leader == w.leadership.leader {
+		return
+	}
+
+	w.leadership.leader = leader
+	w.callbacks.OnNewLeader(leader)
+}
+
+// Whether our work as leader is ready.
+func (w *Watchdog) isReady() bool {
+	if r, ok := w.callbacks.(readiness); ok {
+		return r.ready()
+	}
+
+	return true
+}
+
+// Leader returns the current leader as far as we know, or NullId if there isn't one.
+func (w *Watchdog) Leader() Id {
+	result := make(chan Id, 1)
+
+	if !w.timers.sync(func() {
+		result <- w.leader
+	}) {
+		return NullId
+	}
+
+	return <-result
+}
+
+// Where we stand in the election, as of one moment on the queue.
+type electionStatus struct {
+	state  state
+	term   uint64
+	leader Id
+	// Whether we lead and may work as leader.
+	active bool
+}
+
+// Reads our election status on the queue, so it doesn't race with the election. Reports
+// false if we've shut down.
+func (w *Watchdog) status() (electionStatus, bool) {
+	result := make(chan electionStatus, 1)
+
+	if !w.timers.sync(func() {
+		result <- electionStatus{w.state, w.currentTerm, w.leader, w.state == StateLeading && w.canRunProcess}
+	}) {
+		return electionStatus{}, false
+	}
+
+	return <-result, true
+}
@@ -0,0 +1,219 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Waits for the goroutines started since there were before to finish, failing if they don't.
+func expectGoroutinesToFinish(t *testing.T, before int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			stacks := make([]byte, 1<<20)
+			stacks = stacks[:runtime.Stack(stacks, true)]
+
+			t.Fatalf("%d goroutines were left running, from %d:\n%s", runtime.NumGoroutine()-before, before, stacks)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// UDP addresses on localhost that nothing is listening on.
+func freeUDPAddrs(t *testing.T, n int) []string {
+	addrs := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+
+		addrs = append(addrs, conn.LocalAddr().String())
+	}
+
+	return addrs
+}
+
+// Fast timings, for a leader to be elected well within a second.
+func leakTestConfig(t *testing.T, listenOn string, rest string) Configuration {
+	config, err := ParseEmbeddedConfiguration([]byte(fmt.Sprintf(`
+minElectionTimeout: 50
+maxElectionTimeout: 100
+networkInterval: 200
+heartbeatInterval: 20
+listenOn: %q
+%s`, listenOn, rest)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return config
+}
+
+// A node at each address, from 1.
+func leakTestCluster(t *testing.T, addrs []string) Cluster {
+	nodes := "nodes:\n"
+
+	for i, addr := range addrs {
+		nodes += fmt.Sprintf("  - {id: %d, udpAddr: %q, httpAddr: \"http://node%d\"}\n", i+1, addr, i+1)
+	}
+
+	cluster, err := ParseCluster([]byte(nodes))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cluster
+}
+
+// Works as leader until told to stop.
+type blockingCallbacks struct {
+	started chan struct{}
+}
+
+func (c blockingCallbacks) OnStartedLeading(ctx context.Context) {
+	select {
+	case c.started <- struct{}{}:
+	default:
+	}
+
+	<-ctx.Done()
+}
+
+func (c blockingCallbacks) OnStoppedLeading() {}
+
+func (c blockingCallbacks) OnNewLeader(Id) {}
+
+func TestWatchdogShutdownLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	addrs := freeUDPAddrs(t, 3)
+	cluster := leakTestCluster(t, addrs)
+
+	callbacks := blockingCallbacks{make(chan struct{}, 1)}
+	nodes := make([]*Watchdog, 0)
+
+	for i, addr := range addrs {
+		w := NewWatchdogWithCallbacks(Id(i+1), leakTestConfig(t, addr, "command:\n  stop:\n    gracePeriod: 100\n"), cluster, callbacks)
+
+		if err := w.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		nodes = append(nodes, w)
+	}
+
+	select {
+	case <-callbacks.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no node started leading")
+	}
+
+	for _, w := range nodes {
+		if err := w.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectGoroutinesToFinish(t, before)
+}
+
+func TestWatchdogThatFailsToStartLeavesNoGoroutines(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	before := runtime.NumGoroutine()
+	addr := conn.LocalAddr().String()
+
+	w := NewWatchdogWithCallbacks(1, leakTestConfig(t, addr, ""), leakTestCluster(t, []string{addr}), blockingCallbacks{})
+
+	if err := w.Start(context.Background()); err == nil {
+		t.Fatal("the node started on an address already in use")
+	}
+
+	expectGoroutinesToFinish(t, before)
+}
+
+func TestHostShutdownLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	addrs := freeUDPAddrs(t, 3)
+	cluster := leakTestCluster(t, addrs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hosts := make([]*Host, 0)
+
+	sleep, err := exec.LookPath("sleep")
+
+	if err != nil {
+		t.Skip("sleep is needed as each job's command")
+	}
+
+	for i, addr := range addrs {
+		config := leakTestConfig(t, addr, fmt.Sprintf(`
+jobs:
+  - name: one
+    command: {name: %[1]q, args: [sleep, "60"], stop: {gracePeriod: 100}}
+  - name: two
+    command: {name: %[1]q, args: [sleep, "60"], stop: {gracePeriod: 100}}
+`, sleep))
+
+		h := NewHost(Id(i+1), config, cluster)
+
+		if err := h.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		hosts = append(hosts, h)
+	}
+
+	// Each job's process should be running on one host or another.
+	deadline := time.Now().Add(10 * time.Second)
+
+	for job := range hosts[0].Jobs() {
+		for !anyRunning(hosts, job) {
+			if time.Now().After(deadline) {
+				t.Fatalf("no host started job %d's process", job)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Shutting down as the hosts' context is done.
+	cancel()
+
+	for _, h := range hosts {
+		<-h.Done()
+	}
+
+	expectGoroutinesToFinish(t, before)
+}
+
+func anyRunning(hosts []*Host, job int) bool {
+	for _, h := range hosts {
+		if h.Jobs()[job].supervisor.running() {
+			return true
+		}
+	}
+
+	return false
+}
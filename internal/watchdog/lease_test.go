@@ -0,0 +1,133 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to, and whose timers never fire.
+type manualClock struct {
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	return c.now
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return &manualTimer{c.now.Add(d), f}
+}
+
+type manualTimer struct {
+	at time.Time
+	// What it would run when it fired, for a test to run when it likes.
+	f func()
+}
+
+func (t *manualTimer) Stop() bool {
+	return true
+}
+
+// Node 1, leading a cluster of five from the clock's time.
+func leaseTestLeader(t *testing.T, clock *manualClock) *Watchdog {
+	addrs := make([]string, 0)
+
+	for i := 1; i <= 5; i++ {
+		addrs = append(addrs, fmt.Sprintf("node%d:6000", i))
+	}
+
+	config := leakTestConfig(t, "127.0.0.1:0", "")
+	w := NewWatchdogWithCallbacks(1, config, leakTestCluster(t, addrs), blockingCallbacks{})
+
+	w.clock = clock
+	w.adapter = makeAdapter()
+	w.adapter.transport = &capturingTransport{}
+
+	rank, ranks := w.cluster.priorityRank(w.id)
+	w.timers = newTimers(w.config, clock, w.random, rank, ranks, func() {}, func() {}, func() {}, func() {}, func() {})
+
+	t.Cleanup(func() {
+		_ = w.timers.shutdown(context.Background())
+	})
+
+	w.currentTerm = 1
+	w.transition(StateLeading)
+
+	return w
+}
+
+func leaseExpiry(w *Watchdog) time.Time {
+	return w.timers.leadership.t.(*manualTimer).at
+}
+
+func heartbeatFrom(w *Watchdog, id Id) {
+	w.handleHeartbeat(message{id: id, term: w.currentTerm, mtype: MessageHeartbeat, leader: w.id})
+}
+
+func TestLeaseRunsFromTheOldestHeartbeatOfAMajority(t *testing.T) {
+	start := time.Now()
+	clock := &manualClock{start}
+	w := leaseTestLeader(t, clock)
+	timeout := w.config.leadershipTimeout
+
+	clock.now = start.Add(10 * time.Millisecond)
+	heartbeatFrom(w, 2)
+
+	// Node 2's heartbeat is nearly a lease old by the time node 3's makes a majority.
+	clock.now = start.Add(timeout - 10*time.Millisecond)
+	heartbeatFrom(w, 3)
+
+	if expected := start.Add(10 * time.Millisecond).Add(timeout); !leaseExpiry(w).Equal(expected) {
+		t.Fatalf("the lease should run from node 2's heartbeat, to %s, but runs %s past it", expected, leaseExpiry(w).Sub(expected))
+	}
+
+	// With node 4's, a fresher majority has sent heartbeats.
+	heartbeatFrom(w, 4)
+
+	if expected := clock.now.Add(timeout); !leaseExpiry(w).Equal(expected) {
+		t.Fatalf("the lease should be renewed to %s, but is to %s", expected, leaseExpiry(w))
+	}
+}
+
+// Whatever order heartbeats arrive in, a majority must have sent one within leadershipTimeout of the lease's expiry.
+func TestLeaseNeverOutlastsAMajoritysHeartbeats(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for run := 0; run < 100; run++ {
+		start := time.Now()
+		clock := &manualClock{start}
+		w := leaseTestLeader(t, clock)
+		timeout := w.config.leadershipTimeout
+		latest := map[Id]time.Time{}
+
+		for i := 0; i < 50; i++ {
+			clock.now = clock.now.Add(time.Millisecond + time.Duration(random.Int63n(int64(timeout))))
+
+			id := Id(2 + random.Intn(4))
+			latest[id] = clock.now
+			heartbeatFrom(w, id)
+
+			if leaseExpiry(w).Equal(start.Add(timeout)) {
+				// Still the lease from our election, which the votes vouch for.
+				continue
+			}
+
+			// Ourselves, and whoever sent a heartbeat since the lease's term began.
+			since := leaseExpiry(w).Add(-timeout)
+			recent := 1
+
+			for _, at := range latest {
+				if !at.Before(since) {
+					recent++
+				}
+			}
+
+			if recent < 3 {
+				t.Fatalf("run %d: the lease runs to %s, but only %d nodes have sent heartbeats since %s", run, leaseExpiry(w).Sub(start), recent, since.Sub(start))
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package watchdog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"single-executor/internal/util"
+	"sync"
+)
+
+type logStream string
+
+const (
+	StreamStdout logStream = "stdout"
+	StreamStderr logStream = "stderr"
+)
+
+type logsConfig struct {
+	// Where output is captured, as <dir>/stdout.log & <dir>/stderr.log.
+	// Output is discarded if empty.
+	dir string
+	// The size, in bytes, at which a log file is rotated.
+	maxSize int64
+	// How many rotated files are kept per stream.
+	maxFiles int
+}
+
+// Captures one of the process' output streams to a rotating log file,
+// and passes each complete line on to anyone following it.
+type processLog struct {
+	writer *util.RotatingWriter
+
+	mu sync.Mutex
+	// The start of a line that has not been finished yet.
+	partial   []byte
+	listeners map[chan []byte]bool
+}
+
+// How many lines a follower may fall behind by before it misses some.
+const logListenerBuffer = 100
+
+func newProcessLogs(config logsConfig) (map[logStream]*processLog, error) {
+	logs := make(map[logStream]*processLog)
+
+	for _, stream := range []logStream{StreamStdout, StreamStderr} {
+		writer, err := util.NewRotatingWriter(filepath.Join(config.dir, string(stream)+".log"), config.maxSize, config.maxFiles)
+
+		if err != nil {
+			return nil, err
+		}
+
+		logs[stream] = &processLog{writer: writer, listeners: make(map[chan []byte]bool)}
+	}
+
+	return logs, nil
+}
+
+func (l *processLog) Write(p []byte) (int, error) {
+	n, err := l.writer.Write(p)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lines := bytes.Split(append(l.partial, p[:n]...), []byte("\n"))
+	l.partial = lines[len(lines)-1]
+
+	for _, line := range lines[:len(lines)-1] {
+		for listener := range l.listeners {
+			select {
+			case listener <- line:
+			default:
+				// Too far behind; we never block the process' output on a follower.
+			}
+		}
+	}
+
+	return n, err
+}
+
+// Receives each line written from now on, until detached.
+func (l *processLog) listen() chan []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	listener := make(chan []byte, logListenerBuffer)
+	l.listeners[listener] = true
+
+	return listener
+}
+
+func (l *processLog) detach(listener chan []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.listeners, listener)
+}
+
+func (l *processLog) tail(n int) ([][]byte, error) {
+	return l.writer.Tail(n)
+}
+
+// Closes the log files, once the process has gone.
+func (w *Watchdog) closeLogs() {
+	for _, log := range w.logs {
+		if err := log.writer.Close(); err != nil {
+			w.error(err)
+		}
+	}
+}
+
+// Sets up the process' stdout & stderr to be captured in our logs, if configured.
+// The returned func must be called once the process has been started (or failed to),
+// to close our copies of the pipes.
+func (w *Watchdog) captureOutput(attr *os.ProcAttr) (func(), error) {
+	pipes := make([]*os.File, 0)
+
+	closePipes := func() {
+		for _, pipe := range pipes {
+			pipe.Close()
+		}
+	}
+
+	if w.logs == nil {
+		return closePipes, nil
+	}
+
+	attr.Files = []*os.File{nil, nil, nil}
+
+	for i, stream := range []logStream{StreamStdout, StreamStderr} {
+		reader, writer, err := os.Pipe()
+
+		if err != nil {
+			closePipes()
+			return nil, err
+		}
+
+		attr.Files[i+1] = writer
+		pipes = append(pipes, writer)
+
+		w.routines.Add(1)
+
+		go w.copyOutput(reader, w.logs[stream])
+	}
+
+	return closePipes, nil
+}
+
+// Copies from reader until every process holding the other end of it has gone.
+func (w *Watchdog) copyOutput(reader *os.File, log *processLog) {
+	defer w.routines.Done()
+	defer reader.Close()
+
+	if _, err := io.Copy(log, reader); err != nil {
+		w.error(fmt.Errorf("Failed to capture process output, discarding it: %s\n", err.Error()))
+
+		// Keep reading, so the process isn't blocked (or killed) for writing to a full pipe.
+		_, _ = io.Copy(ioutil.Discard, reader)
+	}
+}
@@ -0,0 +1,139 @@
+package watchdog
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A watchdog whose process' output is captured to a temporary directory, rotated at maxSize.
+func logsTestWatchdog(t *testing.T, maxSize int64) *Watchdog {
+	logs, err := newProcessLogs(logsConfig{filepath.Join(t.TempDir(), "logs"), maxSize, 3})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Watchdog{logs: logs}
+
+	t.Cleanup(w.closeLogs)
+
+	return w
+}
+
+func TestProcessLogsTail(t *testing.T) {
+	w := logsTestWatchdog(t, 50)
+
+	// Lines written in pieces, past the max size, so some are in rotated files.
+	for i := 0; i < 10; i++ {
+		if _, err := fmt.Fprintf(w.logs[StreamStdout], "line %d", i); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.logs[StreamStdout].Write([]byte("\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		query    string
+		status   int
+		expected string
+	}{
+		{"?tail=5", 200, "line 5\nline 6\nline 7\nline 8\nline 9\n"},
+		{"?tail=0", 200, ""},
+		{"?stream=stderr", 200, ""},
+		{"?tail=-1", http.StatusBadRequest, ""},
+		{"?stream=stdin", http.StatusNotFound, ""},
+	} {
+		response := httptest.NewRecorder()
+		httpMonitor{w}.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/process/logs"+test.query, nil))
+
+		if response.Code != test.status {
+			t.Errorf("%s got %d, expected %d", test.query, response.Code, test.status)
+		} else if test.status == 200 && response.Body.String() != test.expected {
+			t.Errorf("%s got %q, expected %q", test.query, response.Body.String(), test.expected)
+		}
+	}
+}
+
+func TestProcessLogsFollow(t *testing.T) {
+	w := logsTestWatchdog(t, 1024)
+	server := httptest.NewServer(httpMonitor{w})
+
+	defer server.Close()
+
+	if _, err := w.logs[StreamStderr].Write([]byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := http.Get(server.URL + "/process/logs?stream=stderr&tail=1&follow=true")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("following the logs should be a stream of events, not %s", contentType)
+	}
+
+	events := make(chan string, 10)
+
+	go func() {
+		scanner := bufio.NewScanner(response.Body)
+
+		for scanner.Scan() {
+			if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+				events <- data
+			}
+		}
+
+		close(events)
+	}()
+
+	expectEvent := func(expected string) {
+		t.Helper()
+
+		select {
+		case event := <-events:
+			if event != expected {
+				t.Fatalf("got event %q, expected %q", event, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event for %q", expected)
+		}
+	}
+
+	// First the tail, then each line as it's finished.
+	expectEvent("before")
+
+	// Having had the tail, we're listening, as that starts before the tail is read.
+	if _, err := w.logs[StreamStderr].Write([]byte("after, in ")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.logs[StreamStderr].Write([]byte("pieces\nand another\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvent("after, in pieces")
+	expectEvent("and another")
+
+	// Another stream's output isn't followed.
+	if _, err := w.logs[StreamStdout].Write([]byte("elsewhere\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-events:
+		t.Fatalf("got event %q from stdout", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
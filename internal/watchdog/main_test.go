@@ -0,0 +1,13 @@
+package watchdog
+
+import (
+	"os"
+	"testing"
+)
+
+// The test binary starts commands with a umask or rlimits through itself, as the watchdog does.
+func TestMain(m *testing.M) {
+	RunExecShim()
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,223 @@
+package watchdog
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+)
+
+// Membership changes are made one node at a time by the leader (single-server
+// changes). Any majority of the old membership overlaps any majority of the new,
+// so two leaders can never be elected by disjoint majorities in the same term.
+//
+// The leader applies a change immediately, then replicates it until a majority
+// of the new membership has acknowledged it, at which point the change is
+// committed and the next may begin. Nodes refuse votes to candidates with an
+// older membership than their own, so a node that missed a committed change
+// cannot win an election using its outdated idea of a majority.
+type membershipChange struct {
+	// The membership before the change. These nodes are told
+	// about the change too, so removed nodes learn of it.
+	previous map[Id]Node
+	// The highest membership version acknowledged by each node.
+	acks map[Id]uint64
+}
+
+// AddNode adds a node to the cluster. This must be called on the leader,
+// and will fail if a previous change has not been committed yet.
+func (w *Watchdog) AddNode(node Node) error {
+	return w.changeMembership(func() (Cluster, error) {
+		return w.cluster.withNode(node)
+	})
+}
+
+// RemoveNode removes a node from the cluster. This must be called on the leader,
+// and will fail if a previous change has not been committed yet. If the leader
+// removes itself, it steps down once the change has been committed.
+func (w *Watchdog) RemoveNode(id Id) error {
+	return w.changeMembership(func() (Cluster, error) {
+		return w.cluster.withoutNode(id)
+	})
+}
+
+func (w *Watchdog) changeMembership(change func() (Cluster, error)) error {
+	result := make(chan error, 1)
+
+	if !w.timers.sync(func() {
+		if w.state != StateLeading {
+			result <- fmt.Errorf("Cannot change membership: this node is %s\n", w.state.String())
+			return
+		}
+
+		if w.pendingMembership != nil {
+			result <- fmt.Errorf("Cannot change membership: version %d is not committed yet\n", w.cluster.version)
+			return
+		}
+
+		next, err := change()
+
+		if err != nil {
+			result <- err
+			return
+		}
+
+		previous := w.cluster.nodes
+
+		w.applyMembership(next)
+		w.startMembershipReplication(previous)
+		w.replicateMembership()
+
+		result <- nil
+	}) {
+		return errShutdown
+	}
+
+	return <-result
+}
+
+// Reports whether the token matches our configured membership token.
+func (w *Watchdog) isMembershipToken(token string) bool {
+	if len(w.config.membershipToken) == 0 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(w.config.membershipToken)) == 1
+}
+
+// Starts tracking acknowledgements for our current membership. A new leader does
+// this for the membership it was elected with too, as it cannot be sure that was
+// committed; no further changes can be made until it has been.
+func (w *Watchdog) startMembershipReplication(previous map[Id]Node) {
+	w.pendingMembership = &membershipChange{previous, map[Id]uint64{w.id: w.cluster.version}}
+}
+
+// Sends our membership to every node that has not yet acknowledged it.
+func (w *Watchdog) replicateMembership() {
+	if w.pendingMembership == nil {
+		return
+	}
+
+	sent := make(map[Id]bool)
+
+	for _, nodes := range []map[Id]Node{w.cluster.nodes, w.pendingMembership.previous} {
+		for id, node := range nodes {
+			if acked, ok := w.pendingMembership.acks[id]; id == w.id || sent[id] || (ok && acked >= w.cluster.version) {
+				continue
+			}
+
+			sent[id] = true
+			w.sendMembership(id, node.udpAddr)
+		}
+	}
+}
+
+func (w *Watchdog) sendMembership(to Id, addr string) {
+	data, err := json.Marshal(w.cluster.record())
+
+	if err != nil {
+		w.error(err)
+		return
+	}
+
+	// Leaving room for the HMAC, if messages are authenticated.
+	if len(data) > maxMessageLength-messageHeaderLength-authTrailerLength {
+		w.error(fmt.Errorf("Membership of %d nodes is too large to send\n", len(w.cluster.nodes)))
+		return
+	}
+
+	m := w.message(MessageMembership)
+	m.payload = data
+
+	w.sendMessage(to, addr, m)
+}
+
+func (w *Watchdog) handleMembership(m message) {
+	if m.membership > w.cluster.version {
+		var record membershipRecord
+
+		if err := json.Unmarshal(m.payload, &record); err != nil {
+			w.error(fmt.Errorf("Malformed membership from %d: %s\n", m.id, err.Error()))
+			return
+		}
+
+		next, err := w.cluster.fromRecord(record)
+
+		if err != nil || next.version != m.membership {
+			w.error(fmt.Errorf("Invalid membership from %d: %v\n", m.id, err))
+			return
+		}
+
+		w.applyMembership(next)
+	}
+
+	addr, err := w.cluster.AddressFor(m.id)
+
+	if err != nil {
+		// The sender is not in our membership, e.g. it removed us and itself.
+		return
+	}
+
+	w.sendMessage(m.id, addr, w.message(MessageMembershipAck))
+}
+
+func (w *Watchdog) handleMembershipAck(id Id, version uint64) {
+	if w.state != StateLeading || w.pendingMembership == nil {
+		return
+	}
+
+	if acked, ok := w.pendingMembership.acks[id]; !ok || version > acked {
+		w.pendingMembership.acks[id] = version
+	}
+
+	// Committed once a majority of the new membership has it.
+	acked := createVotes(w.cluster)
+
+	for node, v := range w.pendingMembership.acks {
+		if v >= w.cluster.version {
+			acked = acked.vote(node)
+		}
+	}
+
+	if !acked.isMajority() {
+		return
+	}
+
+	w.pendingMembership = nil
+	w.event(fmt.Sprintf("committed membership version %d", w.cluster.version))
+
+	if _, err := w.cluster.AddressFor(w.id); err != nil {
+		// We removed ourselves; our job is done.
+		w.event("stepping down, no longer a member")
+		w.transition(StateIdle)
+	}
+}
+
+// Switches to a new membership and persists it.
+func (w *Watchdog) applyMembership(next Cluster) {
+	w.useCluster(next)
+
+	if err := w.persist(); err != nil {
+		w.error(err)
+	}
+
+	w.event(fmt.Sprintf("membership version %d: %d nodes", next.version, len(next.nodes)))
+
+	if _, err := w.cluster.AddressFor(w.id); err != nil && w.state != StateLeading {
+		// We've been removed. Having no role, we will no longer vote or stand for election.
+		w.event("removed from the cluster")
+		w.transition(StateIdle)
+	}
+}
+
+func (w *Watchdog) useCluster(next Cluster) {
+	// The maps are replaced rather than modified, as they may be read elsewhere.
+	w.cluster.nodes = next.nodes
+	w.cluster.version = next.version
+
+	if w.adapter != nil {
+		w.adapter.nodes.update(w.config.jobId, w.cluster)
+	}
+
+	w.votes = createVotes(w.cluster)
+	w.preVotes = createVotes(w.cluster)
+}
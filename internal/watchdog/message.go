@@ -1,13 +1,23 @@
 package watchdog
 
-import "fmt"
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+)
 
 type messageType byte
 
 const (
-	MessageVote        messageType = 0x01
-	MessageVoteRequest messageType = 0x02
-	MessageHeartbeat   messageType = 0x03
+	MessageVote           messageType = 0x01
+	MessageVoteRequest    messageType = 0x02
+	MessageHeartbeat      messageType = 0x03
+	MessagePreVote        messageType = 0x04
+	MessagePreVoteRequest messageType = 0x05
+	MessageTimeoutNow     messageType = 0x06
+	MessageMembership     messageType = 0x07
+	MessageMembershipAck  messageType = 0x08
+	MessageResign         messageType = 0x09
 )
 
 func (t messageType) ToString() string {
@@ -18,35 +28,107 @@ func (t messageType) ToString() string {
 		return "vote-for-me"
 	case MessageHeartbeat:
 		return "heartbeat"
+	case MessagePreVote:
+		return "pre-vote-for"
+	case MessagePreVoteRequest:
+		return "pre-vote-for-me"
+	case MessageTimeoutNow:
+		return "timeout-now"
+	case MessageMembership:
+		return "membership"
+	case MessageMembershipAck:
+		return "membership-ack"
+	case MessageResign:
+		return "resign"
 	}
 
 	return ""
 }
 
+// The wire format version. Every message starts with this byte so
+// that nodes running incompatible versions reject each other's messages
+// rather than misreading them.
+//
+// Version 3 layout (big endian):
+//   [0]      version
+//   [1]      type
+//   [2:4]    source id
+//   [4:6]    leader id
+//   [6:10]   job id
+//   [10:18]  term
+//   [18:26]  membership version
+//   [26:28]  payload length
+//   [28:]    payload
+const messageVersion byte = 0x03
+
+const messageHeaderLength = 28
+
+// The largest message we will send or accept, bounded by what fits in a UDP datagram.
+const maxMessageLength = 65507
+
 type message struct {
 	id    Id
-	term  uint8
+	term  uint64
 	mtype messageType
+	// The sender's leader. In a vote request, the leader that handed over to the candidate, if any.
 	leader Id
+	// The version of the cluster membership the sender is using.
+	membership uint64
+	// Type-specific data, e.g. the nodes for a MessageMembership.
+	payload []byte
+	// The job whose election this message is part of. See jobId.
+	job uint32
 }
 
 func (m message) Serialize() []byte {
-	return []byte{byte(m.id), m.term, byte(m.mtype), byte(m.leader)}
+	data := make([]byte, messageHeaderLength+len(m.payload))
+
+	data[0] = messageVersion
+	data[1] = byte(m.mtype)
+	binary.BigEndian.PutUint16(data[2:4], uint16(m.id))
+	binary.BigEndian.PutUint16(data[4:6], uint16(m.leader))
+	binary.BigEndian.PutUint32(data[6:10], m.job)
+	binary.BigEndian.PutUint64(data[10:18], m.term)
+	binary.BigEndian.PutUint64(data[18:26], m.membership)
+	binary.BigEndian.PutUint16(data[26:28], uint16(len(m.payload)))
+	copy(data[messageHeaderLength:], m.payload)
+
+	return data
 }
 
 func (m message) String() string {
-	return fmt.Sprintf("source: %d, term: %d, type: %s", m.id, m.term, m.mtype.ToString())
+	return fmt.Sprintf("source: %d, job: %d, term: %d, type: %s", m.id, m.job, m.term, m.mtype.ToString())
+}
+
+// The name of the job run when only a single command is configured.
+const DefaultJob = "default"
+
+// Identifies a job on the wire, by hashing its name. Every node must name its jobs the same.
+func jobId(name string) uint32 {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(name))
+
+	return hash.Sum32()
 }
 
 func messageFromBytes(data []byte) (err error, m message) {
-	if len(data) != 4 {
+	if len(data) == 0 {
+		err = fmt.Errorf("Empty UDP message\n")
+	} else if data[0] != messageVersion {
+		err = fmt.Errorf("Unsupported message version %d (expected %d)\n", data[0], messageVersion)
+	} else if len(data) < messageHeaderLength {
 		err = fmt.Errorf("Malformed UDP message %x\n", data)
+	} else if payloadLength := int(binary.BigEndian.Uint16(data[26:28])); len(data) != messageHeaderLength+payloadLength {
+		err = fmt.Errorf("Malformed UDP message: expected %d payload bytes, got %d\n", payloadLength, len(data)-messageHeaderLength)
 	} else {
 		m = message{
-			Id(data[0]),
-			data[1],
-			messageType(data[2]),
-			Id(data[3]),
+			Id(binary.BigEndian.Uint16(data[2:4])),
+			binary.BigEndian.Uint64(data[10:18]),
+			messageType(data[1]),
+			Id(binary.BigEndian.Uint16(data[4:6])),
+			binary.BigEndian.Uint64(data[18:26]),
+			data[messageHeaderLength:],
+			binary.BigEndian.Uint32(data[6:10]),
 		}
 	}
 
@@ -0,0 +1,94 @@
+package watchdog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessagesRoundTrip(t *testing.T) {
+	for _, m := range []message{
+		{id: 1, term: 7, mtype: MessageHeartbeat, leader: 1, membership: 3, payload: []byte{}, job: jobId(DefaultJob)},
+		{id: 65535, term: 1<<64 - 1, mtype: MessageVoteRequest, leader: 2, membership: 1<<64 - 1, payload: []byte{}, job: 1<<32 - 1},
+		{id: 3, term: 2, mtype: MessageMembership, leader: 3, membership: 4, payload: []byte(`{"nodes":[]}`), job: jobId("signer")},
+		{id: 4, term: 9, mtype: MessageTimeoutNow, leader: 5, payload: make([]byte, maxMessageLength-messageHeaderLength), job: jobId("indexer")},
+	} {
+		data := m.Serialize()
+
+		if len(data) != messageHeaderLength+len(m.payload) {
+			t.Errorf("%s serialized to %d bytes, expected a %d byte header and %d byte payload", m, len(data), messageHeaderLength, len(m.payload))
+		}
+
+		if data[0] != messageVersion {
+			t.Errorf("%s serialized as version %d", m, data[0])
+		}
+
+		err, decoded := messageFromBytes(data)
+
+		if err != nil {
+			t.Errorf("%s did not decode: %s", m, err)
+		} else if !reflect.DeepEqual(decoded, m) {
+			t.Errorf("%s decoded as %s (leader %d, membership %d, %d payload bytes)", m, decoded, decoded.leader, decoded.membership, len(decoded.payload))
+		}
+	}
+}
+
+func TestJobsAreHashedByName(t *testing.T) {
+	if jobId("signer") != jobId("signer") {
+		t.Fatal("the same job hashed differently")
+	}
+
+	if jobId("signer") == jobId("indexer") || jobId(DefaultJob) == jobId("signer") {
+		t.Fatal("different jobs hashed the same")
+	}
+}
+
+func TestMalformedMessagesAreRejected(t *testing.T) {
+	valid := message{id: 1, term: 2, mtype: MessageHeartbeat, leader: 1, payload: []byte("abc"), job: jobId(DefaultJob)}.Serialize()
+
+	withVersion := func(version byte, length int) []byte {
+		data := make([]byte, length)
+		copy(data, valid)
+		data[0] = version
+
+		return data
+	}
+
+	withPayloadLength := func(length uint16) []byte {
+		data := append([]byte(nil), valid...)
+		binary.BigEndian.PutUint16(data[26:28], length)
+
+		return data
+	}
+
+	for _, test := range []struct {
+		name  string
+		data  []byte
+		error string
+	}{
+		{"empty", []byte{}, "Empty"},
+		{"version 1", withVersion(0x01, 10), "Unsupported message version 1"},
+		{"version 2", withVersion(0x02, 20), "Unsupported message version 2"},
+		{"version 2, as long as version 3", withVersion(0x02, len(valid)), "Unsupported message version 2"},
+		{"a newer version", withVersion(0x04, len(valid)), "Unsupported message version 4"},
+		{"just the version", valid[:1], "Malformed"},
+		{"a short header", valid[:messageHeaderLength-1], "Malformed"},
+		{"a truncated payload", valid[:len(valid)-1], "expected 3 payload bytes, got 2"},
+		{"trailing bytes", append(append([]byte(nil), valid...), 0), "expected 3 payload bytes, got 4"},
+		{"a longer payload length", withPayloadLength(4), "expected 4 payload bytes, got 3"},
+	} {
+		err, _ := messageFromBytes(test.data)
+
+		if err == nil {
+			t.Errorf("%s was accepted", test.name)
+		} else if !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%s was rejected with %q, expected %q", test.name, err, test.error)
+		}
+	}
+
+	if err, m := messageFromBytes(valid); err != nil || !bytes.Equal(m.payload, []byte("abc")) {
+		t.Fatalf("the valid message was not decoded: %v", err)
+	}
+}
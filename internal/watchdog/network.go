@@ -3,27 +3,133 @@ package watchdog
 import (
 	"fmt"
 	"net"
+	"sync"
 )
 
+// Sends & receives messages over a Transport, ignoring those to and from blacklisted
+// nodes, and (if configured) any that aren't authentic.
 type adapter struct {
+	// The node we send & receive for.
+	self Id
+	// Guards blacklist, which the monitor changes while messages are sent & received.
+	mu        sync.Mutex
 	blacklist []Id
-	cluster Cluster
+	nodes     *directory
+	transport Transport
+	auth      *authenticator
 }
 
-func makeAdapter(cluster Cluster) *adapter {
+func makeAdapter() *adapter {
 	adapter := new(adapter)
 
 	adapter.blacklist = make([]Id, 0)
-	adapter.cluster = cluster
+	adapter.nodes = &directory{clusters: make(map[uint32]Cluster)}
 
 	return adapter
 }
 
+// The membership of each job sharing a transport, which each job updates as it changes. Messages
+// are checked against their own job's membership, as a node may be in one job but not another.
+type directory struct {
+	mu       sync.RWMutex
+	clusters map[uint32]Cluster
+}
+
+func (d *directory) update(job uint32, cluster Cluster) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.clusters[job] = cluster
+}
+
+// The identity of node id, as a member of job.
+func (d *directory) identityFor(job uint32, id Id) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	cluster, ok := d.clusters[job]
+
+	if !ok {
+		return "", fmt.Errorf("job %d is not one of ours", job)
+	}
+
+	return cluster.identityFor(id)
+}
+
+// The identity of the node listening on addr, in whichever job it is a member of.
+func (d *directory) identityAt(addr string) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, cluster := range d.clusters {
+		if identity, err := cluster.identityAt(addr); err == nil {
+			return identity, nil
+		}
+	}
+
+	return "", fmt.Errorf("No node has address %s\n", addr)
+}
+
+// Node id, as a member of any job.
+func (d *directory) node(id Id) (Node, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, cluster := range d.clusters {
+		if node, ok := cluster.nodes[id]; ok {
+			return node, true
+		}
+	}
+
+	return Node{}, false
+}
+
+// Whether node id, in any job, is at addr.
+func (d *directory) isAt(id Id, addr string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, cluster := range d.clusters {
+		if nodeAddr, err := cluster.AddressFor(id); err == nil && nodeAddr == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Makes the configured transport for node self, and loads any keys. This is done on starting, as either can fail.
+func (a *adapter) prepare(self Id, config Configuration, clock Clock) error {
+	transport, err := newTransport(config.transport, a.nodes, self)
+
+	if err != nil {
+		return err
+	}
+
+	auth, err := newAuthenticator(config.auth, clock)
+
+	if err != nil {
+		return err
+	}
+
+	a.self = self
+	a.transport = transport
+	a.auth = auth
+
+	return nil
+}
+
 func (a *adapter) blacklistNode(id Id) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	a.blacklist = append(a.blacklist, id)
 }
 
 func (a *adapter) whitelistNode(id Id) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	newBlacklist := make([]Id, 0)
 
 	for _, candidate := range a.blacklist {
@@ -35,74 +141,101 @@ func (a *adapter) whitelistNode(id Id) {
 	a.blacklist = newBlacklist
 }
 
-func (a *adapter) listen(addr *net.UDPAddr, handler func(message), errorhandler func(error)) error {
-	listener, err := net.ListenUDP("udp", addr)
-
-	if err != nil {
-		return err
-	}
+// A copy of the blacklist, safe to range over while it changes.
+func (a *adapter) blacklisted() []Id {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	go func() {
-		for {
-			data := make([]byte, 8)
+	return append([]Id(nil), a.blacklist...)
+}
 
-			if n, addr, err := listener.ReadFrom(data); err != nil {
-				errorhandler(err)
-			} else {
-				if msg, err := a.receive(data[:n], addr); err != nil {
-					errorhandler(err)
-				} else {
-					handler(msg)
-				}
-			}
+func (a *adapter) listen(addr string, handler func(message), errorhandler func(error)) error {
+	return a.transport.Listen(addr, func(data []byte, from net.Addr) {
+		if msg, err := a.receive(data, from); err != nil {
+			errorhandler(err)
+		} else {
+			handler(msg)
 		}
-	}()
+	}, errorhandler)
+}
 
-	return nil
+// Stops listening, and sends anything still queued. Returns once no more messages will be handled.
+func (a *adapter) close() error {
+	if a.transport == nil {
+		return nil
+	}
+
+	return a.transport.Close()
 }
 
-func (a *adapter) send(addr string, m message) (error, string) {
-	for _, id := range a.blacklist {
-		if nodeAddr, err := a.cluster.AddressFor(id); err == nil && nodeAddr == addr {
+// Sends m to node to, at addr.
+func (a *adapter) send(to Id, addr string, m message) (error, string) {
+	for _, id := range a.blacklisted() {
+		if a.nodes.isAt(id, addr) {
 			// This is a blacklisted address. Do not send.
 			return fmt.Errorf("Ignoring request to send to blacklisted address: %s.\n", addr), ""
 		}
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	data := m.Serialize()
 
-	if err != nil {
-		return err, ""
+	if a.auth != nil {
+		data = a.auth.seal(data, to)
 	}
 
-	if conn, err := net.DialUDP("udp", nil, udpAddr); err != nil {
+	if err := a.transport.Send(addr, data); err != nil {
 		return err, ""
-	} else {
-		defer conn.Close()
+	}
 
-		n, err := conn.Write(m.Serialize())
+	return nil, fmt.Sprintf("NET: sent %d bytes (%s) to %s\n", len(data), m.String(), addr)
+}
+
+func (a *adapter) receive(data []byte, addr net.Addr) (message, error) {
+	var m message
+	var to Id
+	var counter uint64
+
+	if a.auth != nil {
+		opened, recipient, c, err := a.auth.open(data)
 
 		if err != nil {
-			return err, ""
-		} else {
-			return nil, fmt.Sprintf("NET: sent %d bytes (%s) to %s\n", n, m.String(), udpAddr)
+			return m, fmt.Errorf("NET: Dropping %d bytes from %s as %s\n", len(data), addr, err.Error())
 		}
+
+		data, to, counter = opened, recipient, c
 	}
-}
 
-func (a *adapter) receive(data []byte, addr net.Addr) (message, error) {
-	var m message
 	err, m := messageFromBytes(data)
 
 	if err != nil {
 		return m, err
 	}
 
-	for _, id := range a.blacklist {
+	for _, id := range a.blacklisted() {
 		if m.id == id {
 			return m, fmt.Errorf("NET: Ignoring %d bytes (%s) from %s as it is blacklisted\n", len(data), m.String(), addr)
 		}
 	}
 
+	// Only now do we know which node it claims to be from. Its certificate, if it sent one, must be that node's.
+	if peer, ok := addr.(identifiedAddr); ok {
+		identity, err := a.nodes.identityFor(m.job, m.id)
+
+		if err == nil {
+			err = peer.verifyIdentity(identity)
+		}
+
+		if err != nil {
+			return m, fmt.Errorf("NET: Dropping %d bytes (%s) from %s as %s\n", len(data), m.String(), addr, err.Error())
+		}
+	}
+
+	// The HMAC vouches for the node too, and for it being sent to us.
+	if a.auth != nil {
+		if err := a.auth.accept(m.id, to, a.self, counter); err != nil {
+			return m, err
+		}
+	}
+
 	return m, nil
 }
@@ -0,0 +1,183 @@
+package watchdog
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Probes check that the process is actually doing its job, rather than just running.
+//
+// Until the readiness probe has passed, a leader is "starting" rather than "active".
+// If it does not pass within its deadline, we step down. Once ready, a failing liveness
+// probe has the process stopped, which counts as a crash under the restart policy.
+type probeKind string
+
+const (
+	// Runs a command, which must exit successfully.
+	ProbeExec probeKind = "exec"
+	// Connects to an address, which must accept the connection.
+	ProbeTcp probeKind = "tcp"
+	// Gets a URL, which must respond with a 2xx or 3xx status.
+	ProbeHttp probeKind = "http"
+)
+
+type probe struct {
+	kind probeKind
+	// The command, for exec probes.
+	exec hook
+	// The host:port, for tcp probes, or the URL, for http probes.
+	target   string
+	interval time.Duration
+	timeout  time.Duration
+	// How many checks in a row must pass (readiness) or fail (liveness).
+	threshold int
+	// How long the process has to become ready. Readiness only.
+	deadline time.Duration
+}
+
+type probesConfig struct {
+	// Either may be nil, if not configured.
+	readiness *probe
+	liveness  *probe
+}
+
+func (p probe) String() string {
+	if p.kind == ProbeExec {
+		return fmt.Sprintf("%s %s", p.kind, p.exec.command)
+	}
+
+	return fmt.Sprintf("%s %s", p.kind, p.target)
+}
+
+// Checks once, returning why it failed, if it did. Exec probes run with spec, like hooks.
+func (p probe) check(spec execSpec, token FencingToken) error {
+	switch p.kind {
+	case ProbeExec:
+		return runHook(p.exec, spec, token)
+	case ProbeTcp:
+		conn, err := net.DialTimeout("tcp", p.target, p.timeout)
+
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	case ProbeHttp:
+		client := http.Client{Timeout: p.timeout}
+		response, err := client.Get(p.target)
+
+		if err != nil {
+			return err
+		}
+
+		defer response.Body.Close()
+
+		if response.StatusCode >= 400 {
+			return fmt.Errorf("responded %s", response.Status)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown probe %s", p.kind)
+}
+
+// Probes the process p, started under token, for as long as it runs:
+// first until it's ready, and then for as long as it stays alive.
+func (w *Watchdog) watchProcess(p *os.Process, token FencingToken) {
+	probes := w.config.command.probes
+
+	if probes.readiness != nil && !w.awaitReadiness(p, token, *probes.readiness) {
+		return
+	}
+
+	w.timers.sync(func() {
+		if w.supervisor.current(p) {
+			w.processReady = true
+
+			if probes.readiness != nil {
+				w.event(fmt.Sprintf("process %d ready", p.Pid))
+			}
+		}
+	})
+
+	if probes.liveness != nil {
+		w.checkLiveness(p, token, *probes.liveness)
+	}
+}
+
+// Waits for the readiness probe to pass, stepping down if it doesn't by its deadline.
+// Reports whether it passed, or false if the process stopped first.
+func (w *Watchdog) awaitReadiness(p *os.Process, token FencingToken, readiness probe) bool {
+	deadline := time.Now().Add(readiness.deadline)
+	passes := 0
+
+	var err error
+
+	for w.supervisor.current(p) {
+		if err = readiness.check(w.config.command.exec, token); err != nil {
+			passes = 0
+		} else if passes++; passes >= readiness.threshold {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			reason := fmt.Sprintf("process did not become ready within %s", readiness.deadline)
+
+			if err != nil {
+				reason = fmt.Sprintf("%s (%s: %s)", reason, readiness, err.Error())
+			}
+
+			w.timers.sync(func() {
+				if w.currentTerm == token.Term && w.supervisor.current(p) {
+					w.stepDown(reason)
+				}
+			})
+
+			return false
+		}
+
+		time.Sleep(readiness.interval)
+	}
+
+	return false
+}
+
+// Stops the process as a failure once the liveness probe fails too many times in a row.
+func (w *Watchdog) checkLiveness(p *os.Process, token FencingToken, liveness probe) {
+	failures := 0
+
+	for {
+		time.Sleep(liveness.interval)
+
+		if !w.supervisor.current(p) {
+			return
+		}
+
+		err := liveness.check(w.config.command.exec, token)
+
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+
+		message := fmt.Sprintf("liveness probe failed (%d/%d): %s", failures, liveness.threshold, err.Error())
+
+		w.timers.sync(func() {
+			w.event(message)
+		})
+
+		if failures >= liveness.threshold {
+			if err := w.supervisor.fail(p); err != nil {
+				w.error(err)
+			}
+
+			return
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The events w has recorded so far, read on its queue.
+func recordedEvents(w *Watchdog) []string {
+	events := make(chan []string, 1)
+
+	w.timers.sync(func() {
+		recorded := make([]string, 0)
+
+		for _, e := range w.events {
+			recorded = append(recorded, e.event)
+		}
+
+		events <- recorded
+	})
+
+	return <-events
+}
+
+// How many of w's events start with prefix.
+func countEvents(w *Watchdog, prefix string) int {
+	count := 0
+
+	for _, e := range recordedEvents(w) {
+		if strings.HasPrefix(e, prefix) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func waitForEvent(t *testing.T, w *Watchdog, prefix string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for countEvents(w, prefix) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no event starting %q, only %v", prefix, recordedEvents(w))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A server whose health can be changed, counting the checks made of it.
+type probeTarget struct {
+	*httptest.Server
+	healthy atomic.Bool
+	checks  atomic.Int32
+}
+
+func newProbeTarget(t *testing.T, healthy bool) *probeTarget {
+	target := &probeTarget{}
+	target.healthy.Store(healthy)
+	target.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		target.checks.Add(1)
+
+		if !target.healthy.Load() {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	t.Cleanup(target.Close)
+
+	return target
+}
+
+// A leading watchdog running sleep, with the given restart policy & probes, indented to go under command.
+func probeTestWatchdog(t *testing.T, restart string, probes string) *Watchdog {
+	sleep, err := exec.LookPath("sleep")
+
+	if err != nil {
+		t.Skip("sleep is needed for the command")
+	}
+
+	w := leadingTestWatchdog(t, fmt.Sprintf(`
+  name: %q
+  args: [sleep, "60"]
+  stop: {gracePeriod: 100}
+  restart: %s
+  probes:
+%s`, sleep, restart, probes))
+
+	w.startProcess(context.Background(), FencingToken{1, w.id})
+
+	if !w.supervisor.running() {
+		t.Fatal("the process was not started")
+	}
+
+	t.Cleanup(w.stopProcess)
+
+	return w
+}
+
+func ready(w *Watchdog) bool {
+	result := make(chan bool, 1)
+
+	w.timers.sync(func() {
+		result <- w.processReady
+	})
+
+	return <-result
+}
+
+func TestProcessBecomesReadyOnceItsProbePassesEnoughTimes(t *testing.T) {
+	target := newProbeTarget(t, false)
+	w := probeTestWatchdog(t, "{}", fmt.Sprintf(`
+    readiness: {http: %q, interval: 20, threshold: 2, deadline: 5000}
+`, target.URL))
+
+	time.Sleep(100 * time.Millisecond)
+
+	if ready(w) {
+		t.Fatal("the process was ready before its probe passed")
+	}
+
+	w.supervisor.mu.Lock()
+	pid := w.supervisor.process.Pid
+	w.supervisor.mu.Unlock()
+
+	target.healthy.Store(true)
+	waitForEvent(t, w, fmt.Sprintf("process %d ready", pid))
+
+	if !ready(w) {
+		t.Fatal("the process was not ready once its probe passed")
+	}
+
+	if state, _ := w.status(); state.state != StateLeading {
+		t.Fatalf("the node stopped leading, as %s", state.state)
+	}
+}
+
+func TestLeaderStepsDownIfItsProcessIsNotReadyByTheDeadline(t *testing.T) {
+	target := newProbeTarget(t, false)
+	w := probeTestWatchdog(t, "{}", fmt.Sprintf(`
+    readiness: {http: %q, interval: 20, deadline: 300}
+`, target.URL))
+
+	started := time.Now()
+
+	waitForEvent(t, w, "process did not become ready within 300ms (http "+target.URL+": responded 503 Service Unavailable), stepping down")
+
+	if took := time.Since(started); took < 300*time.Millisecond {
+		t.Fatalf("stepped down after %s, before the deadline", took)
+	}
+
+	if state, _ := w.status(); state.state == StateLeading {
+		t.Fatal("the node is still leading")
+	}
+
+	if ready(w) {
+		t.Fatal("the process was ready without passing its probe")
+	}
+}
+
+func TestFailingLivenessProbeStopsTheProcessAsACrash(t *testing.T) {
+	target := newProbeTarget(t, true)
+	w := probeTestWatchdog(t, "{policy: on-failure, initialBackoff: 200, maxCrashes: 0}", fmt.Sprintf(`
+    liveness: {http: %q, interval: 20, threshold: 3}
+`, target.URL))
+
+	// Healthy, however many times it's checked.
+	for target.checks.Load() < 5 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if countEvents(w, "liveness probe failed") != 0 || !w.supervisor.running() {
+		t.Fatal("a healthy process failed its liveness probe")
+	}
+
+	target.healthy.Store(false)
+	waitForEvent(t, w, "process stopped as it failed its liveness probe")
+
+	if failures := countEvents(w, "liveness probe failed"); failures != 3 {
+		t.Fatalf("the process was stopped after %d failures, expected the threshold of 3", failures)
+	}
+
+	// As a crash, it is restarted, even under on-failure, but only after backing off.
+	token := FencingToken{1, w.id}
+
+	if w.supervisor.canStart(token) {
+		t.Fatal("the process could be restarted straight away")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	if !w.supervisor.canStart(token) {
+		t.Fatal("the process could not be restarted after backing off")
+	}
+}
+
+func TestFailingLivenessProbeCountsTowardsACrashLoop(t *testing.T) {
+	target := newProbeTarget(t, false)
+	w := probeTestWatchdog(t, "{maxCrashes: 1, crashWindow: 60000}", fmt.Sprintf(`
+    liveness: {http: %q, interval: 20, threshold: 2}
+`, target.URL))
+
+	waitForEvent(t, w, "process crashed 1 times within 1m0s, stepping down")
+
+	if state, _ := w.status(); state.state == StateLeading {
+		t.Fatal("the node is still leading")
+	}
+}
@@ -0,0 +1,71 @@
+package watchdog
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// The process is started in its own process group, so that anything it forks
+// (e.g. a shell script's children, or worker processes) is signalled along with
+// it, and can be cleaned up after it. Otherwise, these could keep running after
+// we lose leadership.
+
+// How often we check whether a process group has gone.
+const groupCheckInterval = 10 * time.Millisecond
+
+// How long anything left in the group has to go once killed, after the process exits. Killed
+// processes go straight away unless stuck in the kernel, so this is short, rather than the
+// stop grace period. It counts towards the shortest safe leadershipGraceTimeout.
+const groupReapTimeout = time.Second
+
+// The process attributes that start a process as the leader of a new group.
+func groupAttributes() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Sends sig to every process in the group led by pid.
+func signalGroup(pid int, sig syscall.Signal) error {
+	err := syscall.Kill(-pid, sig)
+
+	if err == syscall.ESRCH {
+		// Nothing left to signal.
+		return nil
+	}
+
+	return err
+}
+
+// Kills anything left in the group led by pid, once the leader itself has exited,
+// and waits for it all to go. Any of these that have become our children (i.e. we
+// are their subreaper) are reaped, so they don't linger as zombies.
+func reapGroup(pid int, timeout time.Duration) error {
+	if err := signalGroup(pid, syscall.SIGKILL); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		var status syscall.WaitStatus
+
+		// Only ever reaps members of this group, so won't steal exits from elsewhere.
+		for {
+			reaped, err := syscall.Wait4(-pid, &status, syscall.WNOHANG, nil)
+
+			if err != nil || reaped <= 0 {
+				break
+			}
+		}
+
+		if err := syscall.Kill(-pid, 0); err == syscall.ESRCH {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Processes in group %d did not exit within %s\n", pid, timeout)
+		}
+
+		time.Sleep(groupCheckInterval)
+	}
+}
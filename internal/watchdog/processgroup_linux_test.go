@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func groupGone(pid int) bool {
+	return syscall.Kill(-pid, 0) == syscall.ESRCH
+}
+
+func TestStoppingTheProcessStopsItsWholeGroup(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+
+	if err != nil {
+		t.Skip("sh is needed for the command")
+	}
+
+	// As with command.subreaper, so the killed orphans are reaped by us within
+	// groupReapTimeout, rather than whenever init gets round to it.
+	if err := becomeSubreaper(); err != nil {
+		t.Skipf("could not become a subreaper: %s", err)
+	}
+
+	t.Cleanup(func() {
+		_, _, _ = syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 0, 0)
+	})
+
+	// It forks a child that ignores the stop signal, so outlives it unless the group is cleaned up.
+	w := leadingTestWatchdog(t, fmt.Sprintf(`
+  name: %q
+  args: [sh, -c, "sh -c 'trap \"\" TERM; sleep 60' & sleep 60 & wait"]
+  stop:
+    gracePeriod: 2000
+`, sh))
+
+	w.startProcess(context.Background(), FencingToken{1, w.id})
+
+	w.supervisor.mu.Lock()
+	p := w.supervisor.process
+	w.supervisor.mu.Unlock()
+
+	if p == nil {
+		t.Fatal("the process was not started")
+	}
+
+	// Let it fork.
+	time.Sleep(200 * time.Millisecond)
+
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		w.stopProcess()
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the process did not stop")
+	}
+
+	if !groupGone(p.Pid) {
+		_ = signalGroup(p.Pid, syscall.SIGKILL)
+		t.Fatalf("processes in group %d outlived the process", p.Pid)
+	}
+}
+
+func TestReapGroupReapsOrphansAsSubreaper(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+
+	if err != nil {
+		t.Skip("sh is needed to fork")
+	}
+
+	if err := becomeSubreaper(); err != nil {
+		t.Skipf("could not become a subreaper: %s", err)
+	}
+
+	t.Cleanup(func() {
+		_, _, _ = syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 0, 0)
+	})
+
+	// The leader exits straight away, orphaning its child to us.
+	p, err := os.StartProcess(sh, []string{"sh", "-c", "sleep 60 & exit 0"}, &os.ProcAttr{Sys: groupAttributes()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if groupGone(p.Pid) {
+		t.Fatal("the orphan should still be running")
+	}
+
+	// Once killed, it is our zombie, which would keep the group alive unless reaped.
+	if err := reapGroup(p.Pid, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if !groupGone(p.Pid) {
+		t.Fatalf("processes in group %d are left", p.Pid)
+	}
+}
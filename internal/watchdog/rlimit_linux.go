@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package watchdog
+
+import (
+	"syscall"
+)
+
+// The resource limits that may be configured, by name.
+var rlimitResources = map[string]int{
+	"as":      syscall.RLIMIT_AS,
+	"core":    syscall.RLIMIT_CORE,
+	"cpu":     syscall.RLIMIT_CPU,
+	"data":    syscall.RLIMIT_DATA,
+	"fsize":   syscall.RLIMIT_FSIZE,
+	"memlock": 8, // RLIMIT_MEMLOCK
+	"nofile":  syscall.RLIMIT_NOFILE,
+	"nproc":   6, // RLIMIT_NPROC
+	"stack":   syscall.RLIMIT_STACK,
+}
+
+// Sets a resource limit on ourselves, which the command we then execute inherits.
+func setRlimit(resource int, value uint64) error {
+	return syscall.Setrlimit(resource, &syscall.Rlimit{Cur: value, Max: value})
+}
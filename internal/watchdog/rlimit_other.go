@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package watchdog
+
+import (
+	"fmt"
+)
+
+// Resource limits are only supported on Linux.
+var rlimitResources = map[string]int{}
+
+func setRlimit(resource int, value uint64) error {
+	return fmt.Errorf("Resource limits are only supported on Linux\n")
+}
@@ -1,13 +1,15 @@
 package watchdog
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
-	"os"
+	"sort"
+	"sync"
 	"time"
 )
 
-type Id uint8
+type Id uint16
 
 const NullId Id = 0
 
@@ -23,6 +25,7 @@ const (
 	StateFollowing
 	StateLeading
 	StateElection
+	StatePreElection
 )
 
 func (s state) String() string {
@@ -37,6 +40,8 @@ func (s state) String() string {
 		return "leading"
 	case StateFollowing:
 		return "following"
+	case StatePreElection:
+		return "pre-election"
 	}
 
 	return ""
@@ -45,28 +50,70 @@ func (s state) String() string {
 type event struct {
 	time time.Time
 	event string
-	term uint8
+	term uint64
 }
 
 type Watchdog struct {
 	// Node state.
 	votes       votes
-	currentTerm uint8
+	preVotes    votes
+	currentTerm uint64
 	state       state
 	votedFor    Id
 	leader      Id
-	heartbeats  votes
+	// When each follower last sent us a heartbeat, whilst leading.
+	followerSeen map[Id]time.Time
+	// The node we are handing leadership to, if any.
+	transferTarget Id
+	// The term our leadership grace timer was last started for.
+	graceTerm uint64
+	// Whether our leadership grace has elapsed in this term, so no earlier leader can still be working.
+	graceElapsed bool
+	// The term we stood in after a leader handed over to us, having confirmed its work stopped.
+	handedOverTerm uint64
+	// When we last received any message from each node.
+	lastSeen map[Id]time.Time
+	// A membership change (or a new leader's membership) not yet committed.
+	pendingMembership *membershipChange
 
 	// Mechanics.
-	process *os.Process
+	supervisor *supervisor
+	// The process' captured output, if configured.
+	logs map[logStream]*processLog
+	hooks hookState
+	// We will not stand for election before this time, e.g. after our process crash-looped.
+	candidacyPausedUntil time.Time
 	timers  *timers
+	// What the election's timers & bookkeeping use, and where its election timeout comes from.
+	clock   Clock
+	random  rand.Source
 	canRunProcess bool
+	// Whether the running process has passed its readiness probe (if it has one).
+	processReady bool
+	// What we do as leader, and whether we're doing it.
+	callbacks  Callbacks
+	leadership leadershipState
+	// Leading, but waiting for an operator to activate us (manual recovery).
+	awaitingActivation bool
+	storage stableStorage
 
 	// Network & configuration.
 	id      Id
 	config  Configuration
 	cluster Cluster
 	adapter *adapter
+	// The host running this alongside other jobs, if any.
+	host *Host
+
+	// Lifecycle. stopping is closed when we're asked to shut down, and stopped once we have.
+	running      bool
+	shutdownOnce sync.Once
+	stopping     chan struct{}
+	stopped      chan struct{}
+	// Closed once the poll loop has stopped working as leader, and exited.
+	polled chan struct{}
+	// Any other goroutines that must finish before we've stopped.
+	routines sync.WaitGroup
 
 	// Monitoring & debug.
 	Errors chan error
@@ -74,7 +121,14 @@ type Watchdog struct {
 	events map[time.Time]event
 }
 
+// Creates a watchdog that runs the configured command whilst leading.
 func NewWatchdog(id Id, config Configuration, cluster Cluster) *Watchdog {
+	return NewWatchdogWithCallbacks(id, config, cluster, nil)
+}
+
+// Creates a watchdog that calls callbacks as leadership changes. If nil,
+// it runs the configured command whilst leading.
+func NewWatchdogWithCallbacks(id Id, config Configuration, cluster Cluster, callbacks Callbacks) *Watchdog {
 	w := Watchdog{
 		id: id,
 		config: config,
@@ -82,17 +136,69 @@ func NewWatchdog(id Id, config Configuration, cluster Cluster) *Watchdog {
 		Errors: make(chan error),
 		Info: make(chan []byte),
 		events: make(map[time.Time]event),
+		storage: stableStorage{config.stateFile},
+		lastSeen: make(map[Id]time.Time),
+		stopping: make(chan struct{}),
+		stopped: make(chan struct{}),
+		polled: make(chan struct{}),
+		clock: realClock{},
+		random: rand.NewSource(time.Now().UnixNano()),
+	}
+
+	w.supervisor = newSupervisor(config.command.restart, config.command.stop, w.onProcessExit, w.onProcessCrashLoop)
+	w.callbacks = callbacks
+
+	if w.callbacks == nil {
+		w.callbacks = commandRunner{&w}
 	}
 
 	return &w
 }
 
-func (w *Watchdog) Start() error {
+// Starts taking part in the election, in the background, until ctx is done or Shutdown is called.
+func (w *Watchdog) Start(ctx context.Context) error {
+	if _, ok := w.callbacks.(commandRunner); ok && w.config.command.command == "" {
+		return fmt.Errorf("No command is configured to run whilst leading\n")
+	}
+
 	w.event("start")
 
+	w.votes = createVotes(w.cluster)
+	w.preVotes = createVotes(w.cluster)
+
+	if _, err := w.cluster.AddressFor(w.id); err != nil {
+		// Throw if our ID isn't in the cluster.
+		return err
+	}
+
+	if err := w.restore(); err != nil {
+		return err
+	}
+
+	if w.config.command.logs.dir != "" {
+		logs, err := newProcessLogs(w.config.command.logs)
+
+		if err != nil {
+			return err
+		}
+
+		w.logs = logs
+	}
+
+	if w.config.command.subreaper {
+		if err := becomeSubreaper(); err != nil {
+			return err
+		}
+	}
+
+	rank, ranks := w.cluster.priorityRank(w.id)
+
 	w.timers = newTimers(
 		w.config,
-		rand.NewSource(time.Now().UnixNano()),
+		w.clock,
+		w.random,
+		rank,
+		ranks,
 		w.onElectionTimeout,
 		w.onLeadershipAwareTimeout,
 		w.onHeartBeatInterval,
@@ -100,47 +206,181 @@ func (w *Watchdog) Start() error {
 		w.onLeadershipTimeout,
 	)
 
-	w.votes = createVotes(w.cluster)
-	w.heartbeats = createVotes(w.cluster)
-	w.adapter = makeAdapter(w.cluster)
-
-	if _, err := w.cluster.AddressFor(w.id); err != nil {
-		// Throw if our ID isn't in the cluster.
-		return err
-	}
+	if w.adapter == nil {
+		// Running on our own, rather than as one of a host's jobs.
+		w.adapter = makeAdapter()
+		w.adapter.nodes.update(w.config.jobId, w.cluster)
 
-	err := w.adapter.listen(w.config.listenOn, w.handleMessage, w.error)
+		if err := w.adapter.prepare(w.id, w.config, w.clock); err != nil {
+			_ = w.timers.shutdown(context.Background())
+			w.closeLogs()
+			return err
+		}
 
-	if err != nil {
-		return err
+		if err := w.adapter.listen(w.config.listenOn, w.handleMessage, w.error); err != nil {
+			_ = w.timers.shutdown(context.Background())
+			w.closeLogs()
+			return err
+		}
 	}
 
+	w.running = true
+
 	go func() {
+		defer close(w.polled)
+
 		for {
-			// Periodically check and start/stop process
-			// depending on leader state.
-			if w.state == StateLeading && w.canRunProcess {
-				w.startProcess()
-			} else {
-				w.stopProcess()
+			select {
+			case <-w.stopping:
+				// Stop working as leader, whether or not we still are.
+				w.stopLeading()
+
+				if !w.hasLeadership() {
+					return
+				}
+			default:
+				// Periodically start/stop working as leader
+				// depending on leader state.
+				status, ok := w.status()
+
+				if ok && status.active {
+					w.startLeading(FencingToken{status.term, w.id})
+				} else {
+					w.stopLeading()
+				}
+
+				w.observeLeader(status.leader)
 			}
 
-			time.Sleep(time.Millisecond * 100)
+			time.Sleep(processCheckInterval)
 		}
 	}()
 
-	w.transition(StateIdle)
+	w.routines.Add(1)
+
+	go func() {
+		defer w.routines.Done()
+
+		select {
+		case <-ctx.Done():
+			w.shutdownOnce.Do(func() {
+				go w.shutdown()
+			})
+		case <-w.stopping:
+		}
+	}()
+
+	w.timers.sync(func() {
+		w.transition(StateIdle)
+	})
 
 	return nil
 }
 
+// Shutdown stops us taking part in the election, stopping our work as leader (e.g. our
+// process) first. It returns once everything has stopped, or with ctx's error if ctx is
+// done before then, in which case shutting down carries on in the background.
+func (w *Watchdog) Shutdown(ctx context.Context) error {
+	w.shutdownOnce.Do(func() {
+		go w.shutdown()
+	})
+
+	select {
+	case <-w.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Watchdog) shutdown() {
+	defer close(w.stopped)
+
+	close(w.stopping)
+
+	if !w.running {
+		return
+	}
+
+	// Our work must stop before anything else, as it may need the queue.
+	<-w.polled
+
+	// Only once it has, let our followers elect someone else straight away.
+	w.timers.sync(w.resign)
+
+	if err := w.timers.shutdown(context.Background()); err != nil {
+		w.error(err)
+	}
+
+	w.supervisor.waiting.Wait()
+	w.routines.Wait()
+
+	// Only now has everything we're sending, such as our resignation, been handed over.
+	if w.host == nil {
+		if err := w.adapter.close(); err != nil {
+			w.error(err)
+		}
+	}
+
+	w.closeLogs()
+
+	w.event("shut down")
+}
+
+var errShutdown = fmt.Errorf("The watchdog has been shut down\n")
+
+// Closed once we have shut down.
+func (w *Watchdog) Done() <-chan struct{} {
+	return w.stopped
+}
+
 func (w *Watchdog) onElectionTimeout() {
+	if w.clock.Now().Before(w.candidacyPausedUntil) {
+		// Sit this one out, and check again after another timeout.
+		w.transition(StateIdle)
+		return
+	}
+
+	w.transition(StatePreElection)
+
+	// Before disrupting anyone with a new term, check that we could
+	// actually win an election in it. A node that has been partitioned
+	// will not get a majority here, so its term will not run away.
+	w.preVotes = w.preVotes.vote(w.id)
+
+	m := w.message(MessagePreVoteRequest)
+	m.term = w.currentTerm + 1
+
+	w.broadcast(m)
+	w.checkPreVotes()
+}
+
+// Stands for election in the next term. If the leader handed over to us, handedOverBy is that
+// leader, which our vote request carries so that voters don't refuse us for a higher priority one.
+func (w *Watchdog) startElection(handedOverBy Id) {
+	if !w.cluster.RoleOf(w.id).canLead() {
+		// Witnesses & observers never stand for election.
+		return
+	}
+
 	w.transition(StateElection)
 
 	w.currentTerm++
-	w.votes = w.votes.vote(w.id)
 	w.votedFor = w.id
-	w.broadcast(MessageVoteRequest)
+
+	// Our vote for ourselves must be on disk before anyone can act on it.
+	if err := w.persist(); err != nil {
+		w.error(err)
+		w.transition(StateIdle)
+		return
+	}
+
+	w.votes = w.votes.vote(w.id)
+
+	m := w.message(MessageVoteRequest)
+	m.leader = handedOverBy
+
+	w.broadcast(m)
 }
 
 func (w *Watchdog) onLeadershipAwareTimeout() {
@@ -160,17 +400,46 @@ func (w *Watchdog) onHeartBeatInterval() {
 			if err != nil {
 				w.error(err)
 			} else {
-				w.sendMessage(addr, MessageHeartbeat)
+				w.sendMessage(w.leader, addr, w.message(MessageHeartbeat))
 			}
 		}
 	case StateLeading:
 		// If leading, broadcast a heartbeat to all followers
 		// to confirm we're still active (and elections should not occur).
-		w.broadcast(MessageHeartbeat)
+		w.broadcast(w.message(MessageHeartbeat))
+		w.replicateMembership()
+
+		if w.host != nil && w.canRunProcess && w.transferTarget.IsNull() {
+			if target := w.host.rebalanceTarget(w); !target.IsNull() {
+				w.event(fmt.Sprintf("leading too many jobs, moving this one to %d", target))
+
+				if err := w.beginTransfer(target); err != nil {
+					w.error(err)
+				}
+			}
+		}
 	}
 }
 
 func (w *Watchdog) onLeadershipGraceTimeout() {
+	if w.state != StateLeading || w.currentTerm != w.graceTerm {
+		// Queued before we stopped leading in the term it was started for.
+		return
+	}
+
+	if !w.transferTarget.IsNull() {
+		// We are giving up leadership, so do not start now.
+		return
+	}
+
+	w.graceElapsed = true
+
+	if w.config.recovery == RecoveryManual {
+		w.event("awaiting activation")
+		w.awaitingActivation = true
+		return
+	}
+
 	w.canRunProcess = true
 }
 
@@ -181,8 +450,12 @@ func (w *Watchdog) transition(state state) {
 	w.timers.stopAll()
 	w.leader = NullId
 	w.votes = w.votes.reset()
-	w.heartbeats = w.heartbeats.reset()
+	w.preVotes = w.preVotes.reset()
 	w.canRunProcess = false
+	w.awaitingActivation = false
+	w.transferTarget = NullId
+	w.graceElapsed = false
+	w.pendingMembership = nil
 
 	// Change state.
 	w.state = state
@@ -190,48 +463,108 @@ func (w *Watchdog) transition(state state) {
 	// Configure timers based on the state.
 	switch state {
 	case StateIdle:
-		w.timers.election.start()
+		if w.cluster.RoleOf(w.id).canLead() {
+			w.startElectionTimer()
+		}
 	case StateFollowing:
 		w.timers.leadershipAware.start()
 		w.timers.heartbeat.start()
 	case StateLeading:
-		w.timers.leadershipGrace.start()
+		w.graceTerm = w.currentTerm
+
+		if w.currentTerm == w.handedOverTerm {
+			// The last leader's work has stopped, and no earlier leader's can still be running, so
+			// there's nothing to wait out besides the drift between our clocks.
+			w.timers.leadershipGrace.startFor(w.config.maxClockDrift)
+		} else {
+			w.timers.leadershipGrace.start()
+		}
 		w.timers.heartbeat.start()
 		w.timers.leadership.start()
 		w.leader = w.id
-	case StateElection:
-		w.timers.election.start()
+		w.followerSeen = make(map[Id]time.Time)
+		w.startMembershipReplication(nil)
+	case StateElection, StatePreElection:
+		w.startElectionTimer()
+	}
+
+	w.shareStanding()
+}
+
+// Lets the other jobs on our host know that our state or leader has changed.
+func (w *Watchdog) shareStanding() {
+	if w.host != nil {
+		w.host.observe(w)
+	}
+}
+
+// Starts the election timer, waiting a full election timeout range longer
+// for each other job we lead, so that nodes leading fewer jobs stand first.
+func (w *Watchdog) startElectionTimer() {
+	penalty := time.Duration(0)
+
+	if w.host != nil {
+		penalty = time.Duration(w.host.otherLeaderships(w)) * (w.config.maxElectionTimeout - w.config.minElectionTimeout)
 	}
+
+	w.timers.election.d = w.timers.electionTimeout + penalty
+	w.timers.election.start()
+}
+
+// Builds a message of the given type describing our current state.
+func (w *Watchdog) message(mtype messageType) message {
+	return message{w.id, w.currentTerm, mtype, w.leader, w.cluster.version, nil, w.config.jobId}
 }
 
-func (w *Watchdog) broadcast(t messageType) {
+func (w *Watchdog) broadcast(m message) {
 	for _, node := range w.cluster.nodes {
-		w.sendMessage(node.udpAddr, t)
+		w.sendMessage(node.id, node.udpAddr, m)
 	}
 }
 
-func (w *Watchdog) sendMessage(addr string, mtype messageType) {
+// Sends m to node to, at addr.
+func (w *Watchdog) sendMessage(to Id, addr string, m message) {
+	if _, ok := w.adapter.transport.(nonBlockingTransport); ok {
+		// Sent straight away, so messages leave in the order we send them.
+		w.send(to, addr, m)
+		return
+	}
+
 	// Send this off the main thread to stop blocking if there are network issues.
+	w.routines.Add(1)
+
 	go func () {
-		err, info := w.adapter.send(addr, message{w.id, w.currentTerm, mtype, w.leader})
+		defer w.routines.Done()
 
-		if err != nil {
-			w.error(err)
-		} else {
-			w.info(info)
-		}
+		w.send(to, addr, m)
 	}()
 }
 
+func (w *Watchdog) send(to Id, addr string, m message) {
+	err, info := w.adapter.send(to, addr, m)
+
+	if err != nil {
+		w.error(err)
+	} else {
+		w.info(info)
+	}
+}
+
 func (w *Watchdog) error(err error) {
 	go func() {
-		w.Errors <- err
+		select {
+		case w.Errors <- err:
+		case <-w.stopped:
+		}
 	}()
 }
 
 func (w *Watchdog) info(detail string) {
 	go func() {
-		w.Info <- []byte(detail)
+		select {
+		case w.Info <- []byte(detail):
+		case <-w.stopped:
+		}
 	}()
 }
 
@@ -246,44 +579,116 @@ func (w *Watchdog) event(name string) {
 }
 
 func (w *Watchdog) handleMessage(m message) {
-	if m.term < w.currentTerm {
-		// Old term. Just ignore.
+	if m.job != w.config.jobId {
+		// Part of another job's election.
 		return
 	}
 
 	// Do this synchronously with any other timer-based
 	// triggers.
 	w.timers.sync(func() {
+		if m.term < w.currentTerm {
+			// Old term. Just ignore.
+			return
+		}
+
+		w.lastSeen[m.id] = w.clock.Now()
+
 		switch m.mtype {
 		case MessageVoteRequest:
-			w.handleVoteRequest(m.id, m.term)
+			w.handleVoteRequest(m)
 		case MessageHeartbeat:
-			w.handleHeartbeat(m.id, m.leader)
+			w.handleHeartbeat(m)
 		case MessageVote:
 			w.handleVote(m.id)
+		case MessagePreVoteRequest:
+			w.handlePreVoteRequest(m)
+		case MessagePreVote:
+			w.handlePreVote(m.id, m.term)
+		case MessageTimeoutNow:
+			w.handleTimeoutNow(m.id, m.leader, m.payload)
+		case MessageMembership:
+			w.handleMembership(m)
+		case MessageMembershipAck:
+			w.handleMembershipAck(m.id, m.membership)
+		case MessageResign:
+			w.handleResign(m.id, m.leader)
 		}
 	})
 }
 
-func (w *Watchdog) handleHeartbeat(id Id, leader Id) {
+func (w *Watchdog) handleHeartbeat(m message) {
+	id, term, leader := m.id, m.term, m.leader
+
 	if w.state == StateLeading && leader == w.id {
 		w.info(fmt.Sprintf("Received follower heartbeat %d\n", id))
 
-		w.heartbeats = w.heartbeats.vote(id)
+		w.followerSeen[id] = w.clock.Now()
 
-		if w.heartbeats.isMajority() {
-			w.timers.leadership.start()
-			w.heartbeats = w.heartbeats.reset().vote(w.id)
+		if w.cluster.preemption && w.cluster.RoleOf(id).canLead() && w.cluster.PriorityOf(id) > w.cluster.PriorityOf(w.id) && w.transferTarget.IsNull() {
+			// A preferred node is healthy again; give leadership back to it.
+			w.event(fmt.Sprintf("preempted by higher priority node %d", id))
+
+			if err := w.beginTransfer(id); err != nil {
+				w.error(err)
+			}
+		}
+
+		if renewed, ok := w.leaseRenewal(); ok {
+			w.timers.leadership.startFor(renewed.Add(w.config.leadershipTimeout).Sub(w.clock.Now()))
+		}
+
+		// Followers tell us which membership they have with every heartbeat.
+		if m.membership < w.cluster.version {
+			if addr, err := w.cluster.AddressFor(id); err == nil {
+				w.sendMembership(id, addr)
+			}
 		}
+
+		w.handleMembershipAck(id, m.membership)
 	} else if id == leader {
 		w.info(fmt.Sprintf("Detected leader %d\n", id))
-		w.leader = id
-		w.timers.leadershipAware.start()
+		// Adopt the leader's term so that any later election, and the
+		// fencing token it produces, is always ahead of this leadership.
+		w.newTerm(term)
 
 		if w.state != StateFollowing {
 			w.transition(StateFollowing)
 		}
+
+		w.leader = id
+		w.shareStanding()
+		w.timers.leadershipAware.start()
+	}
+}
+
+// When our leadership was last confirmed by a majority, which our lease runs from: the oldest
+// of the latest heartbeats from the majority that sent theirs most recently, counting our own
+// as now. Any of them may have voted for another leader since sending it, but not before.
+// Reports false if we've yet to hear from a majority.
+func (w *Watchdog) leaseRenewal() (time.Time, bool) {
+	voters := createVotes(w.cluster)
+	seen := make([]time.Time, 0, len(voters))
+
+	for id := range voters {
+		if id == w.id {
+			seen = append(seen, w.clock.Now())
+		} else if at, ok := w.followerSeen[id]; ok {
+			seen = append(seen, at)
+		}
+	}
+
+	majority := len(voters)/2 + 1
+
+	if len(seen) < majority {
+		return time.Time{}, false
 	}
+
+	sort.Slice(seen, func(i, j int) bool {
+		return seen[i].After(seen[j])
+	})
+
+	return seen[majority-1], true
 }
 
 func (w *Watchdog) handleVote(id Id) {
@@ -295,7 +700,9 @@ func (w *Watchdog) handleVote(id Id) {
 	}
 }
 
-func (w *Watchdog) handleVoteRequest(id Id, term uint8) {
+func (w *Watchdog) handleVoteRequest(m message) {
+	id, term := m.id, m.term
+
 	if w.state == StateLeading || w.state == StateFollowing {
 		// Nothing to do here.
 		return
@@ -310,6 +717,10 @@ func (w *Watchdog) handleVoteRequest(id Id, term uint8) {
 		return
 	}
 
+	if !w.canVoteFor(m) {
+		return
+	}
+
 	addr, err := w.cluster.AddressFor(id)
 
 	if err != nil {
@@ -317,64 +728,186 @@ func (w *Watchdog) handleVoteRequest(id Id, term uint8) {
 		return
 	}
 
+	w.votedFor = id
+
+	// Never send a vote that we could forget about after a crash.
+	if err := w.persist(); err != nil {
+		w.error(err)
+		w.votedFor = NullId
+		return
+	}
+
 	w.event(fmt.Sprintf("voted for %d", id))
 
-	w.sendMessage(addr, MessageVote)
-	w.votedFor = id
+	w.sendMessage(id, addr, w.message(MessageVote))
 }
 
-func (w *Watchdog) newTerm(term uint8) {
-	if term <= w.currentTerm {
+func (w *Watchdog) handlePreVoteRequest(m message) {
+	id, term := m.id, m.term
+
+	if id == w.id {
+		// Already counted our own.
 		return
 	}
 
-	w.currentTerm = term
-	w.votedFor = NullId
-	w.leader = NullId
-}
+	if w.state == StateLeading || w.state == StateFollowing {
+		// We have a healthy leader, so no need for an election.
+		return
+	}
 
-func (w *Watchdog) startProcess() {
-	if w.isProcessRunning() {
+	if term <= w.currentTerm {
+		// The candidate is behind us; it could not win.
 		return
 	}
 
-	attr := new(os.ProcAttr)
+	if !w.canVoteFor(m) {
+		return
+	}
 
-	p, err := os.StartProcess(w.config.command.command, w.config.command.args, attr)
+	addr, err := w.cluster.AddressFor(id)
 
 	if err != nil {
 		w.error(err)
+		return
 	}
 
-	w.process = p
+	// Note that unlike a real vote, this changes none of our state.
+	// The reply carries the proposed term so the candidate can match it.
+	reply := w.message(MessagePreVote)
+	reply.term = term
+
+	w.sendMessage(id, addr, reply)
 }
 
-func (w *Watchdog) stopProcess() {
-	if w.isProcessRunning() {
-		go func() {
-			// Need to Wait() to read exit status from the child process
-			// otherwise it sits in a zombie state indefinitely.
-			// Do this in a separate thread as we don't want to block the current.
-			if _, err := w.process.Wait(); err != nil {
-				w.error(err)
-			}
+func (w *Watchdog) handlePreVote(id Id, term uint64) {
+	if w.state != StatePreElection || term != w.currentTerm+1 {
+		// A stale pre-vote from an earlier round.
+		return
+	}
+
+	w.preVotes = w.preVotes.vote(id)
+	w.checkPreVotes()
+}
 
-			// Once it's gone, unset everything.
-			w.process = nil
-		}()
+// Whether we may give our vote (or pre-vote) to the candidate at all.
+func (w *Watchdog) canVoteFor(m message) bool {
+	candidate := m.id
 
-		if err := w.process.Kill(); err != nil {
-			w.error(err)
+	if !w.cluster.RoleOf(w.id).votes() || !w.cluster.RoleOf(candidate).canLead() {
+		return false
+	}
+
+	if m.membership < w.cluster.version {
+		// The candidate has missed a membership change, so its idea of a
+		// majority may be wrong. This is what stops two disjoint majorities.
+		return false
+	}
+
+	if m.mtype == MessageVoteRequest && !m.leader.IsNull() {
+		// The leader handed over to the candidate, so it is who the cluster wants, whatever its priority.
+		return true
+	}
+
+	return !w.preferredOver(candidate)
+}
+
+// Reports whether a node with a higher priority than the candidate is healthy
+// (including ourselves, unless we've stepped down), in which case we would rather it led and refuse our vote.
+func (w *Watchdog) preferredOver(candidate Id) bool {
+	priority := w.cluster.PriorityOf(candidate)
+	standing := !w.clock.Now().Before(w.candidacyPausedUntil)
+
+	for id, node := range w.cluster.nodes {
+		if id == candidate || !node.role.canLead() || node.priority <= priority {
+			continue
+		}
+
+		if seen, ok := w.lastSeen[id]; (id == w.id && standing) || (id != w.id && ok && w.clock.Now().Sub(seen) < w.config.networkInterval) {
+			w.event(fmt.Sprintf("refused vote for %d, preferring %d", candidate, id))
+			return true
 		}
 	}
+
+	return false
+}
+
+func (w *Watchdog) checkPreVotes() {
+	if w.preVotes.isMajority() {
+		w.event("won pre-vote")
+		w.startElection(NullId)
+	}
 }
 
-func (w *Watchdog) isProcessRunning() bool {
-	if w.process == nil {
-		return false
+func (w *Watchdog) newTerm(term uint64) {
+	if term <= w.currentTerm {
+		return
+	}
+
+	w.currentTerm = term
+	w.votedFor = NullId
+	w.leader = NullId
+	w.shareStanding()
+
+	if err := w.persist(); err != nil {
+		w.error(err)
+	}
+}
+
+// Loads any previously persisted term and vote.
+func (w *Watchdog) restore() error {
+	state, exists, err := w.storage.load()
+
+	if err != nil {
+		return err
+	}
+
+	if !w.storage.enabled() {
+		w.event("no state file configured, term & vote will not survive a restart")
+	} else if !exists {
+		w.event("no previous state found, starting from term 0")
+	} else {
+		w.currentTerm = state.CurrentTerm
+		w.votedFor = state.VotedFor
+		w.event(fmt.Sprintf("restored state, voted for %d", state.VotedFor))
+	}
+
+	if state.Membership != nil && state.Membership.Version > w.cluster.version {
+		cluster, err := w.cluster.fromRecord(*state.Membership)
+
+		if err != nil {
+			return fmt.Errorf("State file %s has invalid membership: %s\n", w.storage.path, err.Error())
+		}
+
+		w.useCluster(cluster)
+		w.event(fmt.Sprintf("restored membership version %d", cluster.version))
+	}
+
+	return nil
+}
+
+func (w *Watchdog) persist() error {
+	state := persistentState{w.currentTerm, w.votedFor, nil}
+
+	if w.cluster.version > 0 {
+		record := w.cluster.record()
+		state.Membership = &record
+	}
+
+	return w.storage.save(state)
+}
+
+// Gives up leadership as we cannot run the process, handing over to another node if
+// we can. We then sit out elections for a while, so we don't just win the next one.
+func (w *Watchdog) stepDown(reason string) {
+	if w.state != StateLeading {
+		return
 	}
 
-	_, err := os.FindProcess(w.process.Pid)
+	w.event(fmt.Sprintf("%s, stepping down", reason))
 
-	return err == nil
+	w.candidacyPausedUntil = w.clock.Now().Add(w.config.command.restart.crashWindow)
+
+	if err := w.beginTransfer(NullId); err != nil {
+		w.transition(StateIdle)
+	}
 }
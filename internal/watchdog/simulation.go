@@ -0,0 +1,712 @@
+package watchdog
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Simulation runs several watchdogs in one process, over a simulated network and on a
+// virtual clock, to test the election without docker. Everything that happens is decided
+// by the seed: the same seed, configuration and faults always give the same run, so any
+// failure can be replayed exactly. Invariants are checked after every step.
+//
+// A step is one event: a node's timer going off, a message arriving or a scheduled fault.
+// Time only passes between steps, jumping straight to the next event, so simulating
+// minutes takes moments.
+//
+// Only the election is simulated. Nodes lead with callbacks that do nothing, nothing is
+// persisted and each node runs only the first configured job. Leadership transfers are
+// not deterministic, as they wait (in real time) for the leader's work to stop.
+type Simulation struct {
+	config SimulationConfig
+	// The nodes, by id and in order of id.
+	nodes map[Id]*Watchdog
+	ids   []Id
+	// Nodes that have been stopped.
+	stopped map[Id]bool
+
+	mu     sync.Mutex
+	start  time.Time
+	now    time.Time
+	events simulatedEvents
+	// How many events each node has had scheduled, which orders events due at the same time.
+	scheduled map[Id]uint64
+	network   *simulatedNetwork
+
+	steps int
+	trace []string
+	// Messages lost during this step. Nodes send in no particular order (e.g. when
+	// broadcasting), so these are sorted before they're added to the trace.
+	lost []string
+	// The leader of each term, as seen so far.
+	leaders map[uint64]Id
+}
+
+type SimulationConfig struct {
+	Seed int64
+	// Every node is run with this configuration, and is a node in this cluster.
+	Configuration Configuration
+	Cluster       Cluster
+	Network       NetworkConditions
+	// Checked after every step. Defaults to DefaultInvariants.
+	Invariants []Invariant
+}
+
+// How the simulated network treats messages. They can be changed during a simulation.
+type NetworkConditions struct {
+	// Each message takes a random time between these to arrive.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// The chance that each message is lost, from 0 to 1.
+	Loss float64
+	// Whether messages from one node to another may overtake each other.
+	Reorder bool
+}
+
+// Checks something that must always hold, returning an error if it doesn't.
+type Invariant struct {
+	Name  string
+	Check func(s *Simulation) error
+}
+
+// What a node looks like between steps.
+type SimulatedNode struct {
+	Id     Id
+	State  state
+	Term   uint64
+	Leader Id
+	// Whether it is leading, and has been allowed to start working as leader.
+	Active bool
+}
+
+// A broken invariant, and how to get back to it.
+type SimulationError struct {
+	Seed      int64
+	Step      int
+	Elapsed   time.Duration
+	Invariant string
+	Err       error
+}
+
+func (e SimulationError) Error() string {
+	return fmt.Sprintf("seed %d, step %d (%s): %s: %s", e.Seed, e.Step, e.Elapsed, e.Invariant, e.Err.Error())
+}
+
+// At most one node leads each term.
+var OneLeaderPerTerm = Invariant{"one leader per term", func(s *Simulation) error {
+	for _, node := range s.Nodes() {
+		if node.State != StateLeading {
+			continue
+		}
+
+		if leader, ok := s.leaders[node.Term]; ok && leader != node.Id {
+			return fmt.Errorf("nodes %d and %d both led term %d", leader, node.Id, node.Term)
+		}
+
+		s.leaders[node.Term] = node.Id
+	}
+
+	return nil
+}}
+
+// At most one node works as leader at once, e.g. runs the process.
+var OneActiveLeader = Invariant{"one active leader", func(s *Simulation) error {
+	active := make([]Id, 0)
+
+	for _, node := range s.Nodes() {
+		if node.Active {
+			active = append(active, node.Id)
+		}
+	}
+
+	if len(active) > 1 {
+		return fmt.Errorf("nodes %v are all working as leader", active)
+	}
+
+	return nil
+}}
+
+var DefaultInvariants = []Invariant{OneLeaderPerTerm, OneActiveLeader}
+
+// When virtual time starts. Any fixed time would do.
+var simulationEpoch = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func NewSimulation(config SimulationConfig) *Simulation {
+	if config.Invariants == nil {
+		config.Invariants = DefaultInvariants
+	}
+
+	s := &Simulation{
+		config:    config,
+		nodes:     make(map[Id]*Watchdog),
+		stopped:   make(map[Id]bool),
+		start:     simulationEpoch,
+		now:       simulationEpoch,
+		scheduled: make(map[Id]uint64),
+		leaders:   make(map[uint64]Id),
+	}
+
+	s.network = newSimulatedNetwork(s, config.Network)
+
+	// Simulated nodes persist nothing, and have no process.
+	job := config.Configuration.Jobs()[0]
+	job.stateFile = ""
+	job.command.logs.dir = ""
+	job.command.subreaper = false
+
+	// Each node's randomness is drawn from the seed, in order of id.
+	random := rand.New(rand.NewSource(config.Seed))
+
+	for _, node := range config.Cluster.Nodes() {
+		w := NewWatchdogWithCallbacks(node.id, job, config.Cluster, simulatedCallbacks{})
+
+		w.clock = simulatedClock{s, node.id}
+		w.random = rand.NewSource(random.Int63())
+		w.adapter = makeAdapter()
+		w.adapter.nodes.update(w.config.jobId, w.cluster)
+		w.adapter.transport = &simulatedTransport{s.network, node.id}
+
+		s.nodes[node.id] = w
+		s.ids = append(s.ids, node.id)
+	}
+
+	return s
+}
+
+// Starts every node, in order of id.
+func (s *Simulation) Start() error {
+	for _, id := range s.ids {
+		w := s.nodes[id]
+		auth, err := newAuthenticator(w.config.auth, w.clock)
+
+		if err != nil {
+			return err
+		}
+
+		w.adapter.self = id
+		w.adapter.auth = auth
+
+		if err := w.Start(context.Background()); err != nil {
+			return err
+		}
+
+		if err := w.adapter.listen(w.config.listenOn, w.handleMessage, w.error); err != nil {
+			return err
+		}
+
+		go func() {
+			// Nothing is reported from the nodes, as it comes back in no particular order.
+			for {
+				select {
+				case <-w.Errors:
+				case <-w.Info:
+				case <-w.Done():
+					return
+				}
+			}
+		}()
+
+		s.settle(id)
+	}
+
+	return nil
+}
+
+// Runs the next event, and checks the invariants. Reports false if nothing is left to happen.
+func (s *Simulation) Step() (bool, error) {
+	s.mu.Lock()
+
+	if s.events.Len() == 0 {
+		s.mu.Unlock()
+		return false, nil
+	}
+
+	e := heap.Pop(&s.events).(*simulatedEvent)
+	s.now = e.at
+	cancelled := e.cancelled
+	e.done = true
+	s.mu.Unlock()
+
+	if cancelled {
+		return true, nil
+	}
+
+	s.steps++
+
+	if e.description != "" {
+		s.record(e.description)
+	}
+
+	before := s.Nodes()
+
+	e.fn()
+	s.settle(e.node)
+
+	s.recordLost()
+	s.recordChanges(before)
+
+	for _, invariant := range s.config.Invariants {
+		if err := invariant.Check(s); err != nil {
+			return true, SimulationError{s.config.Seed, s.steps, s.Elapsed(), invariant.Name, err}
+		}
+	}
+
+	return true, nil
+}
+
+// Runs every event due in the next d of virtual time, stopping at the first broken invariant.
+func (s *Simulation) RunFor(d time.Duration) error {
+	s.mu.Lock()
+	until := s.now.Add(d)
+	s.mu.Unlock()
+
+	for {
+		s.mu.Lock()
+		due := s.events.Len() > 0 && !s.events[0].at.After(until)
+		s.mu.Unlock()
+
+		if !due {
+			break
+		}
+
+		if _, err := s.Step(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.now = until
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Runs fn as a step of its own, once after has passed since the simulation started.
+func (s *Simulation) At(after time.Duration, description string, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedule(s.start.Add(after), NullId, description, fn)
+}
+
+// Splits the network into groups of nodes, which can only reach nodes in the same group.
+// Nodes in no group can only reach each other. Messages already on their way are lost if
+// they cross the partition.
+func (s *Simulation) Partition(groups ...[]Id) {
+	s.network.partition(groups)
+	s.record(fmt.Sprintf("partition %v", groups))
+}
+
+// Ends any partition.
+func (s *Simulation) Heal() {
+	s.network.partition(nil)
+	s.record("heal")
+}
+
+// Changes how the network treats messages from now on.
+func (s *Simulation) SetConditions(conditions NetworkConditions) {
+	s.network.setConditions(conditions)
+	s.record(fmt.Sprintf("network %+v", conditions))
+}
+
+// Shuts a node down, as if it were stopped (see Watchdog.Shutdown).
+func (s *Simulation) StopNode(id Id) {
+	if s.stopped[id] {
+		return
+	}
+
+	s.stopped[id] = true
+	s.record(fmt.Sprintf("stop node %d", id))
+
+	_ = s.nodes[id].Shutdown(context.Background())
+	s.recordLost()
+}
+
+// Shuts every node down, together.
+func (s *Simulation) Shutdown() {
+	var nodes sync.WaitGroup
+
+	for _, id := range s.ids {
+		if s.stopped[id] {
+			continue
+		}
+
+		s.stopped[id] = true
+		s.record(fmt.Sprintf("stop node %d", id))
+		nodes.Add(1)
+
+		go func(w *Watchdog) {
+			defer nodes.Done()
+
+			_ = w.Shutdown(context.Background())
+		}(s.nodes[id])
+	}
+
+	nodes.Wait()
+	s.recordLost()
+}
+
+// The nodes that are still running, in order of id.
+func (s *Simulation) Nodes() []SimulatedNode {
+	nodes := make([]SimulatedNode, 0, len(s.ids))
+
+	for _, id := range s.ids {
+		if s.stopped[id] {
+			continue
+		}
+
+		status, ok := s.nodes[id].status()
+
+		if !ok {
+			continue
+		}
+
+		nodes = append(nodes, SimulatedNode{id, status.state, status.term, status.leader, status.active})
+	}
+
+	return nodes
+}
+
+// How much virtual time has passed.
+func (s *Simulation) Elapsed() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.now.Sub(s.start)
+}
+
+// Every step so far, and what changed. Runs with the same seed have the same trace.
+func (s *Simulation) Trace() []string {
+	return s.trace
+}
+
+// Waits until the node has finished with whatever it was doing.
+func (s *Simulation) settle(id Id) {
+	if w, ok := s.nodes[id]; ok && w.timers != nil {
+		w.timers.sync(func() {})
+	}
+}
+
+func (s *Simulation) record(entry string) {
+	s.trace = append(s.trace, fmt.Sprintf("%s %s", s.Elapsed(), entry))
+}
+
+func (s *Simulation) recordLost() {
+	s.mu.Lock()
+	lost := s.lost
+	s.lost = nil
+	s.mu.Unlock()
+
+	sort.Strings(lost)
+
+	for _, entry := range lost {
+		s.record("lost " + entry)
+	}
+}
+
+// Records how each node has changed since before.
+func (s *Simulation) recordChanges(before []SimulatedNode) {
+	previous := make(map[Id]SimulatedNode)
+
+	for _, node := range before {
+		previous[node.Id] = node
+	}
+
+	for _, node := range s.Nodes() {
+		if was, ok := previous[node.Id]; ok && was != node {
+			s.record(fmt.Sprintf("node %d: %s, term %d, leader %d, active %t", node.Id, node.State, node.Term, node.Leader, node.Active))
+		}
+	}
+}
+
+// Adds an event, due at at. s.mu must be held.
+func (s *Simulation) schedule(at time.Time, node Id, description string, fn func()) *simulatedEvent {
+	s.scheduled[node]++
+
+	e := &simulatedEvent{at: at, node: node, sequence: s.scheduled[node], description: description, fn: fn}
+	heap.Push(&s.events, e)
+
+	return e
+}
+
+type simulatedEvent struct {
+	at time.Time
+	// The node it happens to, if any.
+	node        Id
+	sequence    uint64
+	description string
+	fn          func()
+	// Whether it has been stopped, or has happened.
+	cancelled bool
+	done      bool
+}
+
+// Events in the order they happen: by time, and then by node. Each node's events
+// due at the same time happen in the order they were scheduled.
+type simulatedEvents []*simulatedEvent
+
+func (e simulatedEvents) Len() int {
+	return len(e)
+}
+
+func (e simulatedEvents) Less(i, j int) bool {
+	if !e[i].at.Equal(e[j].at) {
+		return e[i].at.Before(e[j].at)
+	}
+
+	if e[i].node != e[j].node {
+		return e[i].node < e[j].node
+	}
+
+	return e[i].sequence < e[j].sequence
+}
+
+func (e simulatedEvents) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+
+func (e *simulatedEvents) Push(x interface{}) {
+	*e = append(*e, x.(*simulatedEvent))
+}
+
+func (e *simulatedEvents) Pop() interface{} {
+	old := *e
+	last := old[len(old)-1]
+	*e = old[:len(old)-1]
+
+	return last
+}
+
+// A node's view of the simulation's virtual clock. Its timers are events for that node.
+type simulatedClock struct {
+	s  *Simulation
+	id Id
+}
+
+func (c simulatedClock) Now() time.Time {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	return c.s.now
+}
+
+func (c simulatedClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	return simulatedTimer{c.s, c.s.schedule(c.s.now.Add(d), c.id, "", f)}
+}
+
+type simulatedTimer struct {
+	s *Simulation
+	e *simulatedEvent
+}
+
+func (t simulatedTimer) Stop() bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+
+	pending := !t.e.cancelled && !t.e.done
+	t.e.cancelled = true
+
+	return pending
+}
+
+// Leadership, in a simulation, is just the election's state.
+type simulatedCallbacks struct{}
+
+func (simulatedCallbacks) OnStartedLeading(ctx context.Context) {
+	<-ctx.Done()
+}
+
+func (simulatedCallbacks) OnStoppedLeading() {}
+
+func (simulatedCallbacks) OnNewLeader(Id) {}
+
+type simulatedNetwork struct {
+	s *Simulation
+
+	mu         sync.Mutex
+	conditions NetworkConditions
+	// Which group each node is in, whilst partitioned.
+	groups map[Id]int
+	// Each node's address, and its handler whilst listening.
+	ids      map[string]Id
+	handlers map[Id]func([]byte, net.Addr)
+	links    map[[2]Id]*simulatedLink
+}
+
+// Messages from one node to another. Each has its own randomness, drawn from the seed,
+// so that what happens on one link is not affected by the order of sends on others.
+type simulatedLink struct {
+	random *rand.Rand
+	// When the last message sent on it arrives, if they're not reordered.
+	last time.Time
+}
+
+func newSimulatedNetwork(s *Simulation, conditions NetworkConditions) *simulatedNetwork {
+	n := &simulatedNetwork{
+		s:          s,
+		conditions: conditions,
+		ids:        make(map[string]Id),
+		handlers:   make(map[Id]func([]byte, net.Addr)),
+		links:      make(map[[2]Id]*simulatedLink),
+	}
+
+	for _, node := range s.config.Cluster.Nodes() {
+		n.ids[node.udpAddr] = node.id
+	}
+
+	return n
+}
+
+func (n *simulatedNetwork) setConditions(conditions NetworkConditions) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.conditions = conditions
+}
+
+func (n *simulatedNetwork) partition(groups [][]Id) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.groups = nil
+
+	if groups == nil {
+		return
+	}
+
+	n.groups = make(map[Id]int)
+
+	for i, group := range groups {
+		for _, id := range group {
+			n.groups[id] = i + 1
+		}
+	}
+}
+
+// Whether a message can get from one node to another right now. n.mu must be held.
+func (n *simulatedNetwork) connected(from Id, to Id) bool {
+	return n.groups == nil || n.groups[from] == n.groups[to]
+}
+
+func (n *simulatedNetwork) link(from Id, to Id) *simulatedLink {
+	key := [2]Id{from, to}
+
+	if link, ok := n.links[key]; ok {
+		return link
+	}
+
+	link := &simulatedLink{random: rand.New(rand.NewSource(n.s.config.Seed ^ int64(from)<<32 ^ int64(to)<<16))}
+	n.links[key] = link
+
+	return link
+}
+
+func (n *simulatedNetwork) send(from Id, addr string, data []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	to, ok := n.ids[addr]
+
+	if !ok {
+		return fmt.Errorf("NET: no simulated node at %s\n", addr)
+	}
+
+	description := describeSimulatedMessage(from, to, data)
+	link := n.link(from, to)
+
+	// Always draw both, so that changing conditions doesn't shift what comes after.
+	lost := link.random.Float64() < n.conditions.Loss
+	delay := n.conditions.MinDelay
+
+	if spread := n.conditions.MaxDelay - n.conditions.MinDelay; spread > 0 {
+		delay += time.Duration(link.random.Int63n(int64(spread) + 1))
+	} else {
+		link.random.Int63()
+	}
+
+	n.s.mu.Lock()
+	defer n.s.mu.Unlock()
+
+	if lost || !n.connected(from, to) {
+		n.s.lost = append(n.s.lost, description)
+		return nil
+	}
+
+	at := n.s.now.Add(delay)
+
+	if !n.conditions.Reorder && at.Before(link.last) {
+		at = link.last
+	}
+
+	link.last = at
+
+	n.s.schedule(at, to, description, func() {
+		n.mu.Lock()
+		handler, listening := n.handlers[to]
+		connected := n.connected(from, to)
+		n.mu.Unlock()
+
+		if listening && connected {
+			handler(data, simulatedAddr(fmt.Sprintf("node-%d", from)))
+		}
+	})
+
+	return nil
+}
+
+func describeSimulatedMessage(from Id, to Id, data []byte) string {
+	if err, m := messageFromBytes(data); err == nil {
+		return fmt.Sprintf("%d->%d %s term %d", from, to, m.mtype.ToString(), m.term)
+	}
+
+	return fmt.Sprintf("%d->%d %d bytes", from, to, len(data))
+}
+
+// A node's connection to the simulated network.
+type simulatedTransport struct {
+	network *simulatedNetwork
+	id      Id
+}
+
+func (t *simulatedTransport) Listen(addr string, handler func([]byte, net.Addr), errorhandler func(error)) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	t.network.handlers[t.id] = handler
+
+	return nil
+}
+
+func (t *simulatedTransport) Send(addr string, data []byte) error {
+	return t.network.send(t.id, addr, data)
+}
+
+func (t *simulatedTransport) Close() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	delete(t.network.handlers, t.id)
+
+	return nil
+}
+
+func (t *simulatedTransport) nonBlocking() {}
+
+type simulatedAddr string
+
+func (a simulatedAddr) Network() string {
+	return "simulated"
+}
+
+func (a simulatedAddr) String() string {
+	return string(a)
+}
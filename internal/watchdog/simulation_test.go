@@ -0,0 +1,165 @@
+package watchdog
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Five voters over a lossy network that reorders messages, and is partitioned or healed every 30s.
+func runSimulation(t *testing.T, seed int64, duration time.Duration) (*Simulation, error) {
+	config, err := ParseEmbeddedConfiguration([]byte(simulationTestConfig))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := "nodes:\n"
+
+	for i := 1; i <= 5; i++ {
+		nodes += fmt.Sprintf("  - {id: %d, udpAddr: \"node%d:6000\", httpAddr: \"http://node%d\"}\n", i, i, i)
+	}
+
+	cluster, err := ParseCluster([]byte(nodes))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSimulation(SimulationConfig{
+		Seed:          seed,
+		Configuration: config,
+		Cluster:       cluster,
+		Network:       NetworkConditions{MinDelay: time.Millisecond, MaxDelay: 50 * time.Millisecond, Loss: 0.01, Reorder: true},
+	})
+
+	random := rand.New(rand.NewSource(seed))
+
+	for at := 30 * time.Second; at < duration; at += 30 * time.Second {
+		if random.Intn(2) == 0 {
+			s.At(at, "", s.Heal)
+			continue
+		}
+
+		var a, b []Id
+
+		for _, node := range cluster.Nodes() {
+			if random.Intn(2) == 0 {
+				a = append(a, node.id)
+			} else {
+				b = append(b, node.id)
+			}
+		}
+
+		s.At(at, "", func() {
+			s.Partition(a, b)
+		})
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Shutdown()
+
+	return s, s.RunFor(duration)
+}
+
+func TestSimulationKeepsInvariants(t *testing.T) {
+	for seed := int64(1); seed <= 10; seed++ {
+		if _, err := runSimulation(t, seed, 5*time.Minute); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	first, err := runSimulation(t, 7, 2*time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := runSimulation(t, 7, 2*time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := first.Trace(), second.Trace()
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			t.Fatalf("the runs diverged at step %d:\n%s\n%s", i, a[i], b[i])
+		}
+	}
+
+	if len(a) != len(b) {
+		t.Fatalf("one run had %d steps, the other %d", len(a), len(b))
+	}
+
+	if len(a) == 0 {
+		t.Fatal("nothing was traced")
+	}
+}
+
+// A node cut off from the rest can't win a pre-vote, so its term doesn't run away, and
+// rejoining doesn't depose the leader with it.
+func TestPartitionedNodeRejoiningLeavesTheLeadersTermAlone(t *testing.T) {
+	s := newTestSimulation(t, 3, `
+nodes:
+  - {id: 1, udpAddr: "node1:6000", httpAddr: "http://node1"}
+  - {id: 2, udpAddr: "node2:6000", httpAddr: "http://node2"}
+  - {id: 3, udpAddr: "node3:6000", httpAddr: "http://node3"}
+`)
+
+	var leader SimulatedNode
+
+	runUntil(t, s, "a leader", func() bool {
+		for _, node := range s.Nodes() {
+			if node.Active {
+				leader = node
+				return true
+			}
+		}
+
+		return false
+	})
+
+	isolated := leader.Id%3 + 1
+	rest := make([]Id, 0)
+
+	for _, node := range s.Nodes() {
+		if node.Id != isolated {
+			rest = append(rest, node.Id)
+		}
+	}
+
+	// Long enough for it to time out many times over.
+	s.Partition([]Id{isolated}, rest)
+
+	if err := s.RunFor(2 * time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if term := simulatedNode(s, isolated).Term; term != leader.Term {
+		t.Fatalf("node %d moved from term %d to %d whilst partitioned", isolated, leader.Term, term)
+	}
+
+	s.Heal()
+
+	if err := s.RunFor(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range s.Nodes() {
+		if node.Term != leader.Term || node.Leader != leader.Id {
+			t.Errorf("node %d should follow node %d in term %d, got leader %d in term %d", node.Id, leader.Id, leader.Term, node.Leader, node.Term)
+		}
+	}
+
+	if !simulatedNode(s, leader.Id).Active {
+		t.Errorf("node %d stopped working as leader", leader.Id)
+	}
+}
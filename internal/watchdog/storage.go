@@ -0,0 +1,109 @@
+package watchdog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The node state that must survive a restart. Without it, a node
+// that restarts mid-term could vote twice in that term and help
+// elect two leaders.
+type persistentState struct {
+	CurrentTerm uint64 `json:"currentTerm"`
+	VotedFor    Id     `json:"votedFor"`
+	// Only present once the membership has changed from the cluster file.
+	Membership *membershipRecord `json:"membership,omitempty"`
+}
+
+// Crash-safe storage of persistentState in a single file.
+// An empty path disables persistence entirely.
+type stableStorage struct {
+	path string
+}
+
+func (s stableStorage) enabled() bool {
+	return len(s.path) > 0
+}
+
+// Loads the stored state. A missing file is not an error and
+// results in the zero state, as is the case for a brand new node.
+func (s stableStorage) load() (state persistentState, exists bool, err error) {
+	if !s.enabled() {
+		return
+	}
+
+	data, err := os.ReadFile(s.path)
+
+	if os.IsNotExist(err) {
+		return state, false, nil
+	} else if err != nil {
+		return state, false, fmt.Errorf("Could not read state file %s: %s\n", s.path, err.Error())
+	}
+
+	if err = json.Unmarshal(data, &state); err != nil {
+		// Refuse to guess; starting from scratch could mean voting twice in a term.
+		return state, true, fmt.Errorf("State file %s is corrupt (%s). Remove it only once this node's votes in recent terms are no longer relevant\n", s.path, err.Error())
+	}
+
+	return state, true, nil
+}
+
+// Durably stores the state. The data is written to a temporary file which
+// is synced and then renamed over the previous state, so a crash at any
+// point leaves either the old or the new state on disk, never a partial one.
+func (s stableStorage) save(state persistentState) error {
+	if !s.enabled() {
+		return nil
+	}
+
+	data, err := json.Marshal(state)
+
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(s.path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	// Sync the directory too, otherwise the rename itself may not survive a crash.
+	d, err := os.Open(dir)
+
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,135 @@
+package watchdog
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMissingStateStartsAtTermZero(t *testing.T) {
+	storage := stableStorage{filepath.Join(t.TempDir(), "state.json")}
+	state, exists, err := storage.load()
+
+	if err != nil || exists {
+		t.Fatalf("a missing state file should load as nothing, got exists %t, error %v", exists, err)
+	}
+
+	if state.CurrentTerm != 0 || !state.VotedFor.IsNull() {
+		t.Fatalf("a missing state file should start at term 0, with no vote, got %+v", state)
+	}
+}
+
+func TestStateSurvivesSaving(t *testing.T) {
+	// The directory is made if need be.
+	storage := stableStorage{filepath.Join(t.TempDir(), "watchdog", "state.json")}
+
+	if err := storage.save(persistentState{7, 2, nil}); err != nil {
+		t.Fatal(err)
+	}
+
+	state, exists, err := storage.load()
+
+	if err != nil || !exists || state.CurrentTerm != 7 || state.VotedFor != 2 {
+		t.Fatalf("saved term 7 and a vote for 2, loaded %+v (exists %t, error %v)", state, exists, err)
+	}
+
+	// Nothing is left behind from writing it.
+	entries, err := os.ReadDir(filepath.Dir(storage.path))
+
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected only the state file, found %d files (%v)", len(entries), err)
+	}
+}
+
+func TestCorruptStateIsAHardError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	if err := os.WriteFile(path, []byte(`{"currentTerm": 7, "votedFor"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := (stableStorage{path}).load(); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("a corrupt state file should not load, got %v", err)
+	}
+
+	// Nor will the node start, rather than risk voting twice in a term.
+	addrs := freeUDPAddrs(t, 3)
+	w := NewWatchdogWithCallbacks(1, leakTestConfig(t, addrs[0], "stateFile: "+path), leakTestCluster(t, addrs), blockingCallbacks{})
+
+	if err := w.Start(context.Background()); err == nil {
+		_ = w.Shutdown(context.Background())
+		t.Fatal("the node started with a corrupt state file")
+	}
+}
+
+// Node 1 of three, as if just started with state file path, sending what it would to transport.
+func storageTestNode(t *testing.T, path string) (*Watchdog, *capturingTransport) {
+	addrs := []string{"node1:6000", "node2:6000", "node3:6000"}
+	w := NewWatchdogWithCallbacks(1, leakTestConfig(t, "127.0.0.1:0", "stateFile: "+path), leakTestCluster(t, addrs), blockingCallbacks{})
+
+	transport := &capturingTransport{}
+	w.adapter = makeAdapter()
+	w.adapter.transport = transport
+	w.votes = createVotes(w.cluster)
+	w.preVotes = createVotes(w.cluster)
+
+	if err := w.restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	return w, transport
+}
+
+// How many votes w has sent over transport, once they've all been sent.
+func votesSent(t *testing.T, w *Watchdog, transport *capturingTransport) int {
+	w.routines.Wait()
+
+	votes := 0
+
+	for _, data := range transport.sent {
+		if err, m := messageFromBytes(data); err != nil {
+			t.Fatal(err)
+		} else if m.mtype == MessageVote {
+			votes++
+		}
+	}
+
+	return votes
+}
+
+func TestRestartedNodeRemembersItsVote(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	w, transport := storageTestNode(t, path)
+
+	if w.currentTerm != 0 {
+		t.Fatalf("a new node should start at term 0, not %d", w.currentTerm)
+	}
+
+	w.handleVoteRequest(message{id: 2, term: 5, mtype: MessageVoteRequest})
+
+	if votesSent(t, w, transport) != 1 {
+		t.Fatal("node 1 did not vote for node 2 in term 5")
+	}
+
+	// It restarts, and node 3 asks for its vote in the same term.
+	w, transport = storageTestNode(t, path)
+
+	if w.currentTerm != 5 || w.votedFor != 2 {
+		t.Fatalf("after a restart, node 1 should be in term 5 having voted for 2, got term %d and a vote for %d", w.currentTerm, w.votedFor)
+	}
+
+	w.handleVoteRequest(message{id: 3, term: 5, mtype: MessageVoteRequest})
+
+	if votesSent(t, w, transport) != 0 {
+		t.Fatal("after a restart, node 1 voted twice in term 5")
+	}
+
+	// A later term is a fresh vote.
+	w.handleVoteRequest(message{id: 3, term: 6, mtype: MessageVoteRequest})
+
+	if votesSent(t, w, transport) != 1 || w.votedFor != 3 {
+		t.Fatal("node 1 did not vote for node 3 in term 6")
+	}
+}
@@ -0,0 +1,21 @@
+//go:build linux
+// +build linux
+
+package watchdog
+
+import (
+	"syscall"
+)
+
+// From linux/prctl.h; not exposed by the syscall package.
+const prSetChildSubreaper = 36
+
+// Makes us the subreaper for our descendants: anything orphaned beneath us is
+// re-parented to us rather than init, so we can wait on it.
+func becomeSubreaper() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package watchdog
+
+import (
+	"fmt"
+)
+
+func becomeSubreaper() error {
+	return fmt.Errorf("A subreaper is only supported on Linux\n")
+}
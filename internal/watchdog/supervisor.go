@@ -0,0 +1,398 @@
+package watchdog
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type restartPolicy string
+
+const (
+	// Restart the process whenever it exits.
+	RestartAlways restartPolicy = "always"
+	// Restart the process only if it exits unsuccessfully.
+	RestartOnFailure restartPolicy = "on-failure"
+	// Run the process at most once per leadership.
+	RestartNever restartPolicy = "never"
+)
+
+type restartConfig struct {
+	policy         restartPolicy
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	// Leadership is given up after this many crashes within crashWindow.
+	// Zero disables this.
+	maxCrashes  int
+	crashWindow time.Duration
+}
+
+type stopConfig struct {
+	// Sent to ask the process to stop.
+	signal syscall.Signal
+	// How long the process has to exit before it is killed.
+	gracePeriod time.Duration
+}
+
+// Signals that may be configured to stop the process, by name.
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+type processState string
+
+const (
+	ProcessStopped  processState = "stopped"
+	ProcessRunning  processState = "running"
+	ProcessStopping processState = "stopping"
+)
+
+// How a process came to exit.
+type processExit struct {
+	// The leadership it was started under.
+	token FencingToken
+	// Nil if we lost track of the process.
+	state *os.ProcessState
+	// Whether we asked it to stop.
+	requested bool
+	// Whether it outlived its grace period and had to be killed.
+	killed bool
+	// Whether we stopped it for failing its liveness probe. This counts as a crash.
+	unhealthy bool
+	// Set if anything it left in its process group could not be cleaned up.
+	cleanup error
+}
+
+// Supervises the managed process: detects when it exits, and decides whether
+// and when it may be started again. Restarts back off exponentially, and too
+// many crashes in a short window are reported so the leader can step down.
+//
+// Exits are detected by waiting on the process, so a crashed process is
+// reaped and noticed straight away rather than left as a zombie. Signals go
+// to the process' whole group, and it only counts as exited once everything
+// in its group has gone.
+type supervisor struct {
+	mu     sync.Mutex
+	config restartConfig
+	stop   stopConfig
+	// The real clock, unless a test swaps in its own.
+	clock Clock
+
+	process *os.Process
+	// The leadership the current (or last) process was started under.
+	token FencingToken
+	// Whether we have asked the current process to stop, and whether we've had to kill it.
+	stopping  bool
+	killed    bool
+	// Whether we're stopping it because it's unhealthy, rather than because we were asked to.
+	unhealthy bool
+	startedAt time.Time
+
+	// Whether a process has exited by itself during the current leadership,
+	// and whether that exit was a failure.
+	exited     bool
+	exitFailed bool
+	// Restarts are not allowed before this time.
+	nextStart time.Time
+	backoff   time.Duration
+	crashes   []time.Time
+
+	// Whilst waiting on a process.
+	waiting sync.WaitGroup
+
+	// Called (without the lock held) when a process exits.
+	onExit func(exit processExit)
+	// Called (without the lock held) when crashes exceed the configured limit.
+	onCrashLoop func()
+}
+
+func newSupervisor(config restartConfig, stop stopConfig, onExit func(processExit), onCrashLoop func()) *supervisor {
+	return &supervisor{
+		config:      config,
+		stop:        stop,
+		clock:       realClock{},
+		onExit:      onExit,
+		onCrashLoop: onCrashLoop,
+	}
+}
+
+// Whether a process may be started for the given leadership now,
+// according to the restart policy and any backoff.
+func (s *supervisor) canStart(token FencingToken) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.process != nil {
+		return false
+	}
+
+	if token != s.token {
+		// A new leadership gets a fresh start.
+		s.token = token
+		s.exited = false
+		s.exitFailed = false
+		s.backoff = 0
+		s.nextStart = time.Time{}
+	}
+
+	if s.exited {
+		switch s.config.policy {
+		case RestartNever:
+			return false
+		case RestartOnFailure:
+			if !s.exitFailed {
+				return false
+			}
+		}
+	}
+
+	return !s.clock.Now().Before(s.nextStart)
+}
+
+// Records a process started for the given leadership, and begins waiting on it.
+func (s *supervisor) started(p *os.Process, token FencingToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.process = p
+	s.token = token
+	s.stopping = false
+	s.killed = false
+	s.unhealthy = false
+	s.startedAt = s.clock.Now()
+
+	s.waiting.Add(1)
+
+	go func() {
+		defer s.waiting.Done()
+
+		s.wait(p)
+	}()
+}
+
+// Records that the process could not be started at all. This counts as a crash.
+func (s *supervisor) startFailed() {
+	s.mu.Lock()
+
+	s.exited = true
+	s.exitFailed = true
+	s.backOff()
+	crashLoop := s.crashed()
+
+	s.mu.Unlock()
+
+	if crashLoop {
+		s.onCrashLoop()
+	}
+}
+
+func (s *supervisor) wait(p *os.Process) {
+	state, err := p.Wait()
+
+	if err != nil {
+		// We can no longer track this process. Treat it as gone.
+		state = nil
+	}
+
+	// Whatever it leaves behind must not outlive it.
+	cleanup := reapGroup(p.Pid, groupReapTimeout)
+
+	exit, crashLoop := s.recordExit(state, cleanup)
+
+	s.onExit(exit)
+
+	if crashLoop {
+		s.onCrashLoop()
+	}
+}
+
+// Records that the current process has exited, with state (nil if we lost track of it).
+// Any exit we did not ask for backs off the next start, whether or not it succeeded; only
+// failures count as crashes. Reports whether this takes us over the crash limit.
+func (s *supervisor) recordExit(state *os.ProcessState, cleanup error) (processExit, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requested := s.stopping && !s.unhealthy
+	exit := processExit{s.token, state, requested, s.killed, s.unhealthy, cleanup}
+	crashLoop := false
+
+	s.process = nil
+	s.stopping = false
+	s.killed = false
+
+	if !requested {
+		s.exited = true
+		s.exitFailed = state == nil || !state.Success() || exit.unhealthy
+
+		if s.clock.Now().Sub(s.startedAt) > s.config.maxBackoff {
+			// It ran for a good while, so this is not part of a crash loop.
+			s.backoff = 0
+		}
+
+		s.backOff()
+
+		if s.exitFailed {
+			crashLoop = s.crashed()
+		}
+	}
+
+	return exit, crashLoop
+}
+
+// Doubles the wait before the next start, from initialBackoff up to maxBackoff. Must hold the lock.
+func (s *supervisor) backOff() {
+	if s.backoff == 0 {
+		s.backoff = s.config.initialBackoff
+	} else {
+		s.backoff *= 2
+	}
+
+	if s.backoff > s.config.maxBackoff {
+		s.backoff = s.config.maxBackoff
+	}
+
+	s.nextStart = s.clock.Now().Add(s.backoff)
+}
+
+// Records a crash. Reports whether this takes us over the crash limit. Must hold the lock.
+func (s *supervisor) crashed() bool {
+	now := s.clock.Now()
+
+	if s.config.maxCrashes <= 0 {
+		return false
+	}
+
+	recent := make([]time.Time, 0)
+
+	for _, crash := range append(s.crashes, now) {
+		if now.Sub(crash) <= s.config.crashWindow {
+			recent = append(recent, crash)
+		}
+	}
+
+	s.crashes = recent
+
+	if len(s.crashes) >= s.config.maxCrashes {
+		s.crashes = nil
+		return true
+	}
+
+	return false
+}
+
+// Asks the process to stop, if one is running, with the configured signal.
+// If it has not exited by the end of its grace period, it is killed. Its exit
+// is not counted as a crash. Calling this again whilst stopping does nothing.
+func (s *supervisor) terminate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// We were asked to stop it after all, so it's no longer a crash.
+	s.unhealthy = false
+
+	return s.signal()
+}
+
+// Stops p, if it's still the current process, as it is unhealthy. Unlike terminate,
+// its exit counts as a crash, so it's restarted according to the restart policy.
+func (s *supervisor) fail(p *os.Process) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.process != p || s.stopping {
+		return nil
+	}
+
+	s.unhealthy = true
+
+	return s.signal()
+}
+
+// Signals the process to stop, escalating after its grace period. Must hold the lock.
+func (s *supervisor) signal() error {
+	if s.process == nil || s.stopping {
+		return nil
+	}
+
+	s.stopping = true
+	p := s.process
+
+	if s.stop.signal == syscall.SIGKILL {
+		s.killed = true
+		return signalGroup(p.Pid, syscall.SIGKILL)
+	}
+
+	if err := signalGroup(p.Pid, s.stop.signal); err != nil {
+		s.killed = true
+		return signalGroup(p.Pid, syscall.SIGKILL)
+	}
+
+	s.clock.AfterFunc(s.stop.gracePeriod, func() {
+		s.escalate(p)
+	})
+
+	return nil
+}
+
+// Kills p if it is still the process we're stopping.
+func (s *supervisor) escalate(p *os.Process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.process != p {
+		// It exited in time.
+		return
+	}
+
+	s.killed = true
+
+	// If this fails, the process has most likely just exited by itself.
+	_ = signalGroup(p.Pid, syscall.SIGKILL)
+}
+
+// Whether p is the running process, and has not been asked to stop.
+func (s *supervisor) current(p *os.Process) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.process == p && !s.stopping
+}
+
+// Whether a process is running, i.e. it has been started and not yet exited.
+// A process that has been asked to stop is running until it actually exits.
+func (s *supervisor) running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.process != nil
+}
+
+// The leadership the running process was started under.
+func (s *supervisor) runningToken() (FencingToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.token, s.process != nil
+}
+
+func (s *supervisor) state() processState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.process == nil:
+		return ProcessStopped
+	case s.stopping:
+		return ProcessStopping
+	default:
+		return ProcessRunning
+	}
+}
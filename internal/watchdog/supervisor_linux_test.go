@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestProcessTrappingTheStopSignalIsKilledAfterItsGracePeriod(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+
+	if err != nil {
+		t.Skip("sh is needed for the command")
+	}
+
+	// It ignores SIGTERM, as does the sleep it becomes.
+	w := leadingTestWatchdog(t, fmt.Sprintf(`
+  name: %q
+  args: [sh, -c, "trap '' TERM; exec sleep 60"]
+  stop:
+    signal: SIGTERM
+    gracePeriod: 500
+`, sh))
+
+	w.startProcess(context.Background(), FencingToken{1, w.id})
+
+	w.supervisor.mu.Lock()
+	p := w.supervisor.process
+	w.supervisor.mu.Unlock()
+
+	if p == nil {
+		t.Fatal("the process was not started")
+	}
+
+	// Let it set up its trap.
+	time.Sleep(200 * time.Millisecond)
+
+	started := time.Now()
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		w.stopProcess()
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		_ = signalGroup(p.Pid, syscall.SIGKILL)
+		t.Fatal("the process was not killed")
+	}
+
+	if took := time.Since(started); took < 500*time.Millisecond {
+		t.Fatalf("the process stopped after %s, before its grace period, so it did not trap SIGTERM", took)
+	}
+
+	if !groupGone(p.Pid) {
+		_ = signalGroup(p.Pid, syscall.SIGKILL)
+		t.Fatalf("processes in group %d outlived the process", p.Pid)
+	}
+
+	waitForEvent(t, w, "process killed, as it did not stop within 500ms")
+}
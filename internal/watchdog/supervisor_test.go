@@ -0,0 +1,139 @@
+package watchdog
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func testSupervisor(clock *manualClock, policy restartPolicy, onCrashLoop func()) *supervisor {
+	config := restartConfig{policy, 100 * time.Millisecond, time.Second, 3, 10 * time.Second}
+	s := newSupervisor(config, stopConfig{}, func(processExit) {}, onCrashLoop)
+	s.clock = clock
+
+	return s
+}
+
+// As if a process was started for token, ran for d, and exited with state (nil for a crash).
+func runFor(s *supervisor, clock *manualClock, token FencingToken, d time.Duration, state *os.ProcessState) bool {
+	if !s.canStart(token) {
+		return false
+	}
+
+	s.mu.Lock()
+	s.process = &os.Process{Pid: -1}
+	s.token = token
+	s.startedAt = clock.now
+	s.mu.Unlock()
+
+	clock.now = clock.now.Add(d)
+	_, crashLoop := s.recordExit(state, nil)
+
+	return crashLoop
+}
+
+// How long until s will start another process.
+func backoff(s *supervisor, clock *manualClock) time.Duration {
+	return s.nextStart.Sub(clock.now)
+}
+
+// The state of a process that exited successfully.
+func successfulExit(t *testing.T) *os.ProcessState {
+	cmd := exec.Command("true")
+
+	if err := cmd.Run(); err != nil {
+		t.Skip("true is needed for a successful exit")
+	}
+
+	return cmd.ProcessState
+}
+
+func TestRestartsBackOffUpToTheMaximum(t *testing.T) {
+	for _, exit := range []struct {
+		name  string
+		state *os.ProcessState
+	}{{"crash", nil}, {"clean exit", successfulExit(t)}} {
+		clock := &manualClock{time.Now()}
+		s := testSupervisor(clock, RestartAlways, func() {})
+		s.config.maxCrashes = 0
+		token := FencingToken{1, 1}
+
+		for _, expected := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+			runFor(s, clock, token, 10*time.Millisecond, exit.state)
+
+			if got := backoff(s, clock); got != expected*time.Millisecond {
+				t.Fatalf("after a %s, the backoff was %s, expected %dms", exit.name, got, expected)
+			}
+
+			if s.canStart(token) {
+				t.Fatalf("started again straight after a %s", exit.name)
+			}
+
+			clock.now = s.nextStart
+		}
+	}
+}
+
+func TestBackoffResetsOnceTheProcessRanLongerThanTheMaximum(t *testing.T) {
+	clock := &manualClock{time.Now()}
+	s := testSupervisor(clock, RestartAlways, func() {})
+	token := FencingToken{1, 1}
+
+	runFor(s, clock, token, 10*time.Millisecond, nil)
+	clock.now = s.nextStart
+	runFor(s, clock, token, 10*time.Millisecond, nil)
+
+	if got := backoff(s, clock); got != 200*time.Millisecond {
+		t.Fatalf("the backoff was %s after two crashes, expected 200ms", got)
+	}
+
+	clock.now = s.nextStart
+	runFor(s, clock, token, 2*time.Second, nil)
+
+	if got := backoff(s, clock); got != 100*time.Millisecond {
+		t.Fatalf("the backoff was %s after a long run, expected it to reset to 100ms", got)
+	}
+}
+
+func TestCrashLoopIsReportedWithinTheWindow(t *testing.T) {
+	clock := &manualClock{time.Now()}
+	loops := 0
+	s := testSupervisor(clock, RestartAlways, func() { loops++ })
+	token := FencingToken{1, 1}
+
+	// Two crashes, then a third once they have left the window.
+	for _, gap := range []time.Duration{0, 0, 11 * time.Second} {
+		clock.now = s.nextStart.Add(gap)
+
+		if runFor(s, clock, token, 10*time.Millisecond, nil) {
+			t.Fatalf("a crash loop was reported with only %d crashes in the window", len(s.crashes))
+		}
+	}
+
+	// Clean exits back off, but are not crashes.
+	clock.now = s.nextStart
+
+	if runFor(s, clock, token, 10*time.Millisecond, successfulExit(t)) {
+		t.Fatal("a clean exit was counted as a crash")
+	}
+
+	clock.now = s.nextStart
+	runFor(s, clock, token, 10*time.Millisecond, nil)
+	clock.now = s.nextStart
+
+	if !runFor(s, clock, token, 10*time.Millisecond, nil) {
+		t.Fatal("three crashes within the window were not reported as a crash loop")
+	}
+
+	// Failing to start counts as a crash too.
+	s.startFailed()
+	clock.now = s.nextStart
+	s.startFailed()
+	clock.now = s.nextStart
+	s.startFailed()
+
+	if loops != 1 {
+		t.Fatalf("the crash loop was reported %d times, expected once for three failed starts", loops)
+	}
+}
@@ -0,0 +1,339 @@
+package watchdog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long we wait before connecting again to a node we could not reach, at first and at most.
+const (
+	tcpMinBackoff = 50 * time.Millisecond
+	tcpMaxBackoff = 2 * time.Second
+)
+
+// Each message is framed by its length, as 4 bytes (big endian).
+const tcpFrameHeaderLength = 4
+
+var errTransportClosed = fmt.Errorf("The transport has been closed\n")
+
+// Sends messages over a persistent connection to each node, made when we first send to it
+// and made again whenever it breaks. Each node has its own queue, so one that is slow or
+// unreachable holds up no others. Messages for a node we cannot reach are dropped (as
+// they would be over UDP) rather than queued up, as they would be stale by the time it is back.
+type tcpTransport struct {
+	dialTimeout time.Duration
+	queueLength int
+	// How we listen, connect and tell who connected to us, which TLS replaces.
+	listen   func(addr string) (net.Listener, error)
+	dial     func(addr string) (net.Conn, error)
+	identify func(conn net.Conn) (net.Addr, error)
+
+	mu       sync.Mutex
+	listener net.Listener
+	// Connections other nodes have made to us.
+	inbound map[net.Conn]struct{}
+	peers   map[string]*tcpPeer
+	errorhandler func(error)
+	closed  bool
+	closing chan struct{}
+	// The accept loop, and a goroutine for each connection and peer.
+	routines sync.WaitGroup
+}
+
+// A node we send to.
+type tcpPeer struct {
+	addr  string
+	queue chan []byte
+	conn  net.Conn
+	// Whilst unreachable, we don't try again before retryAt.
+	backoff time.Duration
+	retryAt time.Time
+}
+
+func newTCPTransport(dialTimeout time.Duration, queueLength int) *tcpTransport {
+	return &tcpTransport{
+		dialTimeout: dialTimeout,
+		queueLength: queueLength,
+		listen: func(addr string) (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		},
+		dial: func(addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, dialTimeout)
+		},
+		identify: func(conn net.Conn) (net.Addr, error) {
+			return conn.RemoteAddr(), nil
+		},
+		inbound: make(map[net.Conn]struct{}),
+		peers:   make(map[string]*tcpPeer),
+		closing: make(chan struct{}),
+	}
+}
+
+func (t *tcpTransport) Listen(addr string, handler func([]byte, net.Addr), errorhandler func(error)) error {
+	listener, err := t.listen(addr)
+
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.listener = listener
+	t.errorhandler = errorhandler
+	t.mu.Unlock()
+
+	t.routines.Add(1)
+
+	go func() {
+		defer t.routines.Done()
+
+		for {
+			conn, err := listener.Accept()
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				t.error(err)
+				continue
+			}
+
+			t.mu.Lock()
+
+			if t.closed {
+				t.mu.Unlock()
+				_ = conn.Close()
+				return
+			}
+
+			t.inbound[conn] = struct{}{}
+			t.routines.Add(1)
+			t.mu.Unlock()
+
+			go t.receive(conn, handler)
+		}
+	}()
+
+	return nil
+}
+
+// Reads messages from a connection another node made to us, until it's closed.
+func (t *tcpTransport) receive(conn net.Conn, handler func([]byte, net.Addr)) {
+	defer t.routines.Done()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.inbound, conn)
+		t.mu.Unlock()
+
+		_ = conn.Close()
+	}()
+
+	from, err := t.identify(conn)
+
+	if err != nil {
+		t.error(fmt.Errorf("NET: refusing connection from %s: %s\n", conn.RemoteAddr(), err.Error()))
+		return
+	}
+
+	header := make([]byte, tcpFrameHeaderLength)
+
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			t.receiveFailed(conn, err)
+			return
+		}
+
+		length := binary.BigEndian.Uint32(header)
+
+		if length > maxMessageLength {
+			// We can't find the next message after this one, so give up on the connection.
+			t.error(fmt.Errorf("NET: dropping connection from %s, which sent a %d byte message\n", conn.RemoteAddr(), length))
+			return
+		}
+
+		data := make([]byte, length)
+
+		if _, err := io.ReadFull(conn, data); err != nil {
+			t.receiveFailed(conn, err)
+			return
+		}
+
+		handler(data, from)
+	}
+}
+
+// Reports why a connection from another node ended, unless it was just closed.
+func (t *tcpTransport) receiveFailed(conn net.Conn, err error) {
+	if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		t.error(fmt.Errorf("NET: connection from %s failed: %s\n", conn.RemoteAddr(), err.Error()))
+	}
+}
+
+func (t *tcpTransport) Send(addr string, data []byte) error {
+	if len(data) > maxMessageLength {
+		return fmt.Errorf("NET: cannot send a %d byte message\n", len(data))
+	}
+
+	t.mu.Lock()
+
+	if t.closed {
+		t.mu.Unlock()
+		return errTransportClosed
+	}
+
+	peer, ok := t.peers[addr]
+
+	if !ok {
+		peer = &tcpPeer{addr: addr, queue: make(chan []byte, t.queueLength)}
+		t.peers[addr] = peer
+		t.routines.Add(1)
+
+		go t.send(peer)
+	}
+
+	t.mu.Unlock()
+
+	select {
+	case peer.queue <- data:
+		return nil
+	default:
+		return fmt.Errorf("NET: send queue for %s is full, dropping message\n", addr)
+	}
+}
+
+// Send only ever queues a message.
+func (t *tcpTransport) nonBlocking() {}
+
+// Sends everything queued for peer, in order, until we're closed.
+func (t *tcpTransport) send(peer *tcpPeer) {
+	defer t.routines.Done()
+
+	defer func() {
+		if peer.conn != nil {
+			_ = peer.conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-t.closing:
+			// Still send whatever was queued before then, e.g. a leader's resignation.
+			for {
+				select {
+				case data := <-peer.queue:
+					if err := t.deliver(peer, data); err != nil {
+						t.error(err)
+					}
+				default:
+					return
+				}
+			}
+		case data := <-peer.queue:
+			if err := t.deliver(peer, data); err != nil {
+				t.error(err)
+			}
+		}
+	}
+}
+
+// Writes one message to peer, connecting first if need be. A connection that has
+// broken since we last used it (e.g. the node restarted) is replaced, once.
+func (t *tcpTransport) deliver(peer *tcpPeer, data []byte) error {
+	frame := make([]byte, tcpFrameHeaderLength+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[tcpFrameHeaderLength:], data)
+
+	for attempt := 0; ; attempt++ {
+		if err := t.connect(peer); err != nil {
+			return err
+		}
+
+		_ = peer.conn.SetWriteDeadline(time.Now().Add(t.dialTimeout))
+
+		_, err := peer.conn.Write(frame)
+
+		if err == nil {
+			return nil
+		}
+
+		_ = peer.conn.Close()
+		peer.conn = nil
+
+		if attempt > 0 {
+			return fmt.Errorf("NET: could not send to %s: %s\n", peer.addr, err.Error())
+		}
+	}
+}
+
+func (t *tcpTransport) connect(peer *tcpPeer) error {
+	if peer.conn != nil {
+		return nil
+	}
+
+	if time.Now().Before(peer.retryAt) {
+		return fmt.Errorf("NET: not connected to %s, dropping message\n", peer.addr)
+	}
+
+	conn, err := t.dial(peer.addr)
+
+	if err != nil {
+		peer.backoff *= 2
+
+		if peer.backoff < tcpMinBackoff {
+			peer.backoff = tcpMinBackoff
+		} else if peer.backoff > tcpMaxBackoff {
+			peer.backoff = tcpMaxBackoff
+		}
+
+		peer.retryAt = time.Now().Add(peer.backoff)
+
+		return fmt.Errorf("NET: could not connect to %s, retrying in %s: %s\n", peer.addr, peer.backoff, err.Error())
+	}
+
+	peer.conn = conn
+	peer.backoff = 0
+
+	return nil
+}
+
+func (t *tcpTransport) Close() error {
+	t.mu.Lock()
+
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+
+	t.closed = true
+	close(t.closing)
+
+	var err error
+
+	if t.listener != nil {
+		err = t.listener.Close()
+	}
+
+	for conn := range t.inbound {
+		_ = conn.Close()
+	}
+
+	t.mu.Unlock()
+
+	t.routines.Wait()
+
+	return err
+}
+
+func (t *tcpTransport) error(err error) {
+	t.mu.Lock()
+	errorhandler := t.errorhandler
+	t.mu.Unlock()
+
+	if errorhandler != nil {
+		errorhandler(err)
+	}
+}
@@ -0,0 +1,251 @@
+package watchdog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Waits for the next message r receives.
+func expectReceived(t *testing.T, r *transportRecorder, expected string) {
+	t.Helper()
+
+	select {
+	case data := <-r.received:
+		<-r.from
+
+		if string(data) != expected {
+			t.Fatalf("received %q, expected %q", data, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("did not receive %q", expected)
+	}
+}
+
+// Waits for r to report an error containing text.
+func expectError(t *testing.T, r *transportRecorder, text string) {
+	t.Helper()
+
+	deadline := time.After(5 * time.Second)
+
+	for {
+		select {
+		case err := <-r.errors:
+			if strings.Contains(err.Error(), text) {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("no error reporting %q", text)
+		}
+	}
+}
+
+func TestTCPTransportDeliversInOrderBothWays(t *testing.T) {
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	node1, node2 := newTCPTransport(time.Second, 64), newTCPTransport(time.Second, 64)
+	received1 := listenAndRecord(t, node1, addr1)
+	received2 := listenAndRecord(t, node2, addr2)
+
+	for i := 0; i < 20; i++ {
+		if err := node1.Send(addr2, []byte(fmt.Sprintf("message %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		expectReceived(t, received2, fmt.Sprintf("message %d", i))
+	}
+
+	if err := node2.Send(addr1, []byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectReceived(t, received1, "reply")
+
+	// As large a message as fits in a UDP datagram goes in one piece.
+	large := strings.Repeat("x", maxMessageLength)
+
+	if err := node1.Send(addr2, []byte(large)); err != nil {
+		t.Fatal(err)
+	}
+
+	expectReceived(t, received2, large)
+
+	if err := node1.Send(addr2, []byte(large+"x")); err == nil {
+		t.Fatal("a message too large for a UDP datagram was sent")
+	}
+}
+
+func TestTCPTransportDropsBadFrames(t *testing.T) {
+	addr := freeAddr(t)
+	node := newTCPTransport(time.Second, 8)
+	received := listenAndRecord(t, node, addr)
+
+	frame := func(length uint32, data string) []byte {
+		header := make([]byte, tcpFrameHeaderLength)
+		binary.BigEndian.PutUint32(header, length)
+
+		return append(header, data...)
+	}
+
+	for _, test := range []struct {
+		name  string
+		frame []byte
+		error string
+	}{
+		{"an oversize frame", frame(maxMessageLength+1, "x"), "byte message"},
+		{"a truncated frame", frame(10, "abc"), "failed"},
+		{"a truncated header", frame(3, "abc")[:2], "failed"},
+	} {
+		conn, err := net.Dial("tcp", addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := conn.Write(test.frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if test.name != "an oversize frame" {
+			// The rest of the frame never comes.
+			_ = conn.(*net.TCPConn).CloseWrite()
+		}
+
+		expectError(t, received, test.error)
+
+		// Either way, the connection is given up on.
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("after %s, the connection was not closed: %v", test.name, err)
+		}
+
+		_ = conn.Close()
+
+		select {
+		case data := <-received.received:
+			t.Fatalf("%s was received, as %q", test.name, data)
+		default:
+		}
+	}
+
+	// A good frame still gets through on a new connection.
+	conn, err := net.Dial("tcp", addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write(frame(5, "hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectReceived(t, received, "hello")
+}
+
+func TestTCPTransportReconnectsToARestartedPeer(t *testing.T) {
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	node1 := newTCPTransport(time.Second, 8)
+	errors := listenAndRecord(t, node1, addr1)
+
+	// Nothing is listening yet, so connecting fails, and is retried after a backoff.
+	if err := node1.Send(addr2, []byte("too early")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectError(t, errors, "could not connect")
+
+	node2 := newTCPTransport(time.Second, 8)
+	received := listenAndRecord(t, node2, addr2)
+	sendUntilReceived(t, node1, addr2, received)
+
+	// The peer restarts, breaking our connection to it.
+	if err := node2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTCPTransport(time.Second, 8)
+	received = listenAndRecord(t, restarted, addr2)
+	sendUntilReceived(t, node1, addr2, received)
+}
+
+// Sends to addr until received gets something. Messages sent whilst connecting, or over a
+// connection that has just broken, may be lost, as they would be over UDP.
+func sendUntilReceived(t *testing.T, transport *tcpTransport, addr string, received *transportRecorder) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for time.Now().Before(deadline) {
+		_ = transport.Send(addr, []byte("hello"))
+
+		select {
+		case data := <-received.received:
+			<-received.from
+
+			if string(data) != "hello" {
+				t.Fatalf("received %q, expected hello", data)
+			}
+
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	t.Fatalf("nothing sent to %s was received", addr)
+}
+
+func TestTCPTransportDropsMessagesWhenAPeersQueueIsFull(t *testing.T) {
+	unreachable, reachable := freeAddr(t), freeAddr(t)
+	dialing := make(chan struct{})
+	unblock := make(chan struct{})
+
+	node := newTCPTransport(time.Second, 2)
+	node.dial = func(addr string) (net.Conn, error) {
+		if addr == unreachable {
+			close(dialing)
+			<-unblock
+
+			return nil, fmt.Errorf("unreachable")
+		}
+
+		return net.DialTimeout("tcp", addr, time.Second)
+	}
+
+	listenAndRecord(t, node, freeAddr(t))
+	received := listenAndRecord(t, newTCPTransport(time.Second, 2), reachable)
+
+	defer close(unblock)
+
+	// The first is taken off the queue, and is stuck connecting. Two more fill the queue.
+	if err := node.Send(unreachable, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	<-dialing
+
+	for i := 0; i < 2; i++ {
+		if err := node.Send(unreachable, []byte("queued")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := node.Send(unreachable, []byte("dropped")); err == nil || !strings.Contains(err.Error(), "full") {
+		t.Fatalf("sending to a full queue should fail, got %v", err)
+	}
+
+	// Other peers have queues of their own, so are not held up.
+	if err := node.Send(reachable, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectReceived(t, received, "hello")
+}
@@ -1,41 +1,61 @@
 package watchdog
 
 import (
+	"context"
 	"math/rand"
 	"single-executor/internal/util"
 	"time"
 )
 
 type timer struct {
-	q util.Queue
+	q *util.Queue
+	clock Clock
 	repeat bool
 	f func()
-	t *time.Timer
+	t ClockTimer
 	d time.Duration
+	// Counts each start & stop, so that a callback already queued when the timer was
+	// stopped or restarted is dropped, rather than run as if the new one had fired.
+	armed uint64
 }
 
-func newTimer(queue util.Queue, repeat bool, duration time.Duration, fn func()) *timer {
+func newTimer(queue *util.Queue, clock Clock, repeat bool, duration time.Duration, fn func()) *timer {
 	t := new(timer)
 
 	t.q = queue
+	t.clock = clock
 	t.repeat = repeat
 	t.f = fn
 	t.d = duration
 
-	t.q.Start()
-
 	return t
 }
 
 func (t *timer) start() {
+	t.startFor(t.d)
+}
+
+// Starts the timer to fire after d, rather than its usual duration. Any repeats are after the usual duration.
+func (t *timer) startFor(d time.Duration) {
 	t.stop()
 
+	armed := t.armed
+
 	if t.repeat {
-		// interval timers work on the leading edge too.
-		t.q.Enqueue(t.f)
+		// interval timers work on the leading edge too. Timers are started
+		// from the queue, so this cannot wait for the queue itself.
+		t.clock.AfterFunc(0, t.q.DeferredEnqueue(func() {
+			if t.armed == armed {
+				t.f()
+			}
+		}))
 	}
 
-	t.t = time.AfterFunc(t.d, t.q.DeferredEnqueue(func() {
+	t.t = t.clock.AfterFunc(d, t.q.DeferredEnqueue(func() {
+		if t.armed != armed {
+			return
+		}
+
 		t.f()
 
 		if t.repeat {
@@ -45,6 +65,8 @@ func (t *timer) start() {
 }
 
 func (t *timer) stop() {
+	t.armed++
+
 	if t.t != nil {
 		t.t.Stop()
 	}
@@ -56,11 +78,22 @@ type timers struct {
 	heartbeat       *timer
 	leadershipGrace *timer
 	leadership      *timer
-	q util.Queue
+	q *util.Queue
+	// The election timer's duration, before any penalty for leading other jobs.
+	electionTimeout time.Duration
+}
+
+// Runs fn on the queue, with any other timer-based triggers. Reports
+// false, without running it, if we have been shut down.
+func (t *timers) sync(fn func()) bool {
+	return t.q.Enqueue(fn)
 }
 
-func (t *timers) sync(fn func()) {
-	t.q.Enqueue(fn)
+// Stops every timer, and then the queue, once whatever's running on it has finished.
+func (t *timers) shutdown(ctx context.Context) error {
+	t.sync(t.stopAll)
+
+	return t.q.Stop(ctx)
 }
 
 func (t *timers) stopAll() {
@@ -71,22 +104,39 @@ func (t *timers) stopAll() {
 	t.leadership.stop()
 }
 
-func newTimers(c Configuration, random rand.Source, onElectionTimeout func(), onLeadershipAwareTimeout func(), onHeartBeatInterval func(), onLeadershipGraceTimeout func(), onLeadershipTimeout func()) *timers {
-	queue := make(util.Queue)
-	min := int(c.minElectionTimeout.Milliseconds())
-	max := int(c.maxElectionTimeout.Milliseconds())
+// Picks a random election timeout between the configured min & max.
+// The range is split into one band per priority in the cluster, with
+// higher priorities (lower ranks) getting the earlier bands. This way,
+// healthy higher priority nodes always stand for election first.
+func electionTimeout(c Configuration, random rand.Source, rank int, ranks int) time.Duration {
+	min := c.minElectionTimeout.Milliseconds()
+	max := c.maxElectionTimeout.Milliseconds()
+
+	band := (max - min) / int64(ranks)
+
+	if band < 1 {
+		band = 1
+	}
+
+	ms := (random.Int63() % band) + min + band*int64(rank)
+
+	return msIntToDuration(uint(ms))
+}
 
-	ms := (random.Int63() % int64(max-min)) + int64(min)
+func newTimers(c Configuration, clock Clock, random rand.Source, rank int, ranks int, onElectionTimeout func(), onLeadershipAwareTimeout func(), onHeartBeatInterval func(), onLeadershipGraceTimeout func(), onLeadershipTimeout func()) *timers {
+	queue := util.NewQueue()
+	queue.Start()
 
-	duration := msIntToDuration(uint(ms))
+	duration := electionTimeout(c, random, rank, ranks)
 
 	return &timers{
-		newTimer(queue, false, duration, onElectionTimeout),
-		newTimer(queue, false, c.networkInterval, onLeadershipAwareTimeout),
-		newTimer(queue, true, c.heartbeatInterval, onHeartBeatInterval),
-		newTimer(queue, false, c.networkInterval, onLeadershipGraceTimeout),
-		newTimer(queue, false, c.networkInterval, onLeadershipTimeout),
+		newTimer(queue, clock, false, duration, onElectionTimeout),
+		newTimer(queue, clock, false, c.leadershipAwareTimeout, onLeadershipAwareTimeout),
+		newTimer(queue, clock, true, c.heartbeatInterval, onHeartBeatInterval),
+		newTimer(queue, clock, false, c.leadershipGraceTimeout, onLeadershipGraceTimeout),
+		newTimer(queue, clock, false, c.leadershipTimeout, onLeadershipTimeout),
 		queue,
+		duration,
 	}
 }
 
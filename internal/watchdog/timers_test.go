@@ -0,0 +1,84 @@
+package watchdog
+
+import (
+	"context"
+	"single-executor/internal/util"
+	"testing"
+	"time"
+)
+
+// Waits for everything queued so far to have run.
+func drain(t *testing.T, q *util.Queue) {
+	done := make(chan struct{})
+
+	if !q.Enqueue(func() { close(done) }) {
+		t.Fatal("the queue has stopped")
+	}
+
+	<-done
+}
+
+func TestTimerDropsCallbacksFromBeforeItWasRestarted(t *testing.T) {
+	clock := &manualClock{time.Now()}
+	q := util.NewQueue()
+	q.Start()
+
+	t.Cleanup(func() {
+		_ = q.Stop(context.Background())
+	})
+
+	fired := 0
+	timer := newTimer(q, clock, false, time.Second, func() { fired++ })
+
+	q.Enqueue(timer.start)
+	drain(t, q)
+	stale := timer.t.(*manualTimer).f
+
+	// As if it fired just as it was restarted, its callback only reaching the queue after.
+	q.Enqueue(timer.start)
+	drain(t, q)
+	stale()
+	drain(t, q)
+
+	if fired != 0 {
+		t.Fatalf("the callback from before the restart ran %d times", fired)
+	}
+
+	timer.t.(*manualTimer).f()
+	drain(t, q)
+
+	if fired != 1 {
+		t.Fatalf("the callback ran %d times when the timer fired, expected once", fired)
+	}
+}
+
+func TestLeadershipGraceOnlyAppliesToTheTermItWasStartedFor(t *testing.T) {
+	clock := &manualClock{time.Now()}
+	w := leaseTestLeader(t, clock)
+
+	// We lost leadership in term 1, and are now standing in term 2.
+	w.currentTerm = 2
+	w.transition(StateElection)
+	w.onLeadershipGraceTimeout()
+
+	if w.canRunProcess {
+		t.Fatal("a grace timeout from term 1 allowed the process to run whilst standing for election")
+	}
+
+	// Then leading in term 3, whose own grace has not elapsed.
+	w.currentTerm = 3
+	w.transition(StateLeading)
+	w.graceTerm = 1
+	w.onLeadershipGraceTimeout()
+
+	if w.canRunProcess {
+		t.Fatal("a grace timeout from term 1 allowed the process to run in term 3")
+	}
+
+	w.graceTerm = 3
+	w.onLeadershipGraceTimeout()
+
+	if !w.canRunProcess {
+		t.Fatal("term 3's own grace timeout did not allow the process to run")
+	}
+}
@@ -0,0 +1,438 @@
+package watchdog
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A CA made for a test, which issues node certificates into dir.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	name string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, dir string, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testCA{t, dir, name, cert, key}
+	ca.write(name+".crt", "CERTIFICATE", der)
+
+	return ca
+}
+
+func (ca *testCA) file() string {
+	return filepath.Join(ca.dir, ca.name+".crt")
+}
+
+// Issues a certificate for identity, returning its cert & key files.
+func (ca *testCA) issue(identity string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: identity},
+		DNSNames:     []string{identity},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+
+	name := fmt.Sprintf("%s-%s", ca.name, identity)
+
+	return ca.write(name+".crt", "CERTIFICATE", der), ca.write(name+".key", "EC PRIVATE KEY", keyDer)
+}
+
+func (ca *testCA) write(name string, blockType string, der []byte) string {
+	file := filepath.Join(ca.dir, name)
+
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+
+	return file
+}
+
+// An address on localhost that nothing is listening on.
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+// A cluster of nodes with the given identities, at free addresses, each with a certificate from ca.
+func tlsTestCluster(t *testing.T, ca *testCA, identities ...string) Cluster {
+	nodes := make([]nodeInput, 0)
+
+	for i, identity := range identities {
+		cert, key := ca.issue(identity)
+		nodes = append(nodes, nodeInput{uint16(i + 1), freeAddr(t), "http://" + identity, 0, "", identity, cert, key})
+	}
+
+	cluster, err := newCluster(nodes, 0, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cluster
+}
+
+// What a transport receives, and any errors it reports.
+type transportRecorder struct {
+	received chan []byte
+	from     chan net.Addr
+	errors   chan error
+}
+
+func listenAndRecord(t *testing.T, transport Transport, addr string) *transportRecorder {
+	r := &transportRecorder{make(chan []byte, 16), make(chan net.Addr, 16), make(chan error, 16)}
+
+	handler := func(data []byte, from net.Addr) {
+		r.received <- data
+		r.from <- from
+	}
+
+	errorhandler := func(err error) {
+		select {
+		case r.errors <- err:
+		default:
+		}
+	}
+
+	if err := transport.Listen(addr, handler, errorhandler); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = transport.Close()
+	})
+
+	return r
+}
+
+// The nodes of cluster, as the only job's.
+func testDirectory(cluster *Cluster) *directory {
+	nodes := makeAdapter().nodes
+	nodes.update(jobId(DefaultJob), *cluster)
+
+	return nodes
+}
+
+func newTestTLSTransport(t *testing.T, ca string, cluster *Cluster, self Id) *tcpTransport {
+	transport, err := newTLSTransport(transportConfig{TransportTLS, time.Second, 8, ca, "", ""}, testDirectory(cluster), self)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return transport
+}
+
+func TestTLSTransportDeliversBetweenNodes(t *testing.T) {
+	ca := newTestCA(t, t.TempDir(), "ca")
+	cluster := tlsTestCluster(t, ca, "node1", "node2")
+
+	node1 := newTestTLSTransport(t, ca.file(), &cluster, 1)
+	node2 := newTestTLSTransport(t, ca.file(), &cluster, 2)
+	received := listenAndRecord(t, node1, cluster.nodes[1].udpAddr)
+	listenAndRecord(t, node2, cluster.nodes[2].udpAddr)
+
+	if err := node2.Send(cluster.nodes[1].udpAddr, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-received.received:
+		if string(data) != "hello" {
+			t.Fatalf("received %q, expected hello", data)
+		}
+	case err := <-received.errors:
+		t.Fatalf("node 1 reported %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("node 1 received nothing")
+	}
+
+	from, ok := (<-received.from).(identifiedAddr)
+
+	if !ok {
+		t.Fatal("the sender was not identified by its certificate")
+	}
+
+	if err := from.verifyIdentity("node2"); err != nil {
+		t.Fatalf("the sender should be node 2: %s", err)
+	}
+
+	if err := from.verifyIdentity("node1"); err == nil {
+		t.Fatal("the sender should not pass as node 1")
+	}
+}
+
+func TestTLSTransportRefusesMessagesFromAnotherNodesIdentity(t *testing.T) {
+	ca := newTestCA(t, t.TempDir(), "ca")
+	cluster := tlsTestCluster(t, ca, "node1", "node2", "node3")
+
+	node1 := makeAdapter()
+	node1.nodes.update(jobId(DefaultJob), cluster)
+	node1.transport = newTestTLSTransport(t, ca.file(), &cluster, 1)
+	node2 := newTestTLSTransport(t, ca.file(), &cluster, 2)
+
+	handled := make(chan message, 1)
+	errors := make(chan error, 16)
+
+	if err := node1.listen(cluster.nodes[1].udpAddr, func(m message) { handled <- m }, func(err error) { errors <- err }); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = node1.close()
+		_ = node2.Close()
+	})
+
+	// Node 2 claims to be node 3.
+	forged := message{id: 3, job: jobId(DefaultJob), term: 1, mtype: MessageVote}
+
+	if err := node2.Send(cluster.nodes[1].udpAddr, forged.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-handled:
+		t.Fatalf("node 1 accepted %s from node 2's certificate", m.String())
+	case err := <-errors:
+		if !strings.Contains(err.Error(), `for "node2", not "node3"`) {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("node 1 neither accepted nor refused the message")
+	}
+}
+
+func TestTLSTransportRefusesToSendToTheWrongIdentity(t *testing.T) {
+	ca := newTestCA(t, t.TempDir(), "ca")
+	cluster := tlsTestCluster(t, ca, "node1", "node2", "node3")
+
+	node1 := newTestTLSTransport(t, ca.file(), &cluster, 1)
+	sent := listenAndRecord(t, node1, cluster.nodes[1].udpAddr)
+
+	// Node 3 is listening where node 2 should be.
+	impostor := newTestTLSTransport(t, ca.file(), &cluster, 3)
+	received := listenAndRecord(t, impostor, cluster.nodes[2].udpAddr)
+
+	if err := node1.Send(cluster.nodes[2].udpAddr, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-received.received:
+		t.Fatal("node 1 sent to a node that isn't node 2")
+	case err := <-sent.errors:
+		if !strings.Contains(err.Error(), `for "node3", not "node2"`) {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("node 1 reported nothing")
+	}
+}
+
+func TestTLSTransportRefusesCertificatesFromAnotherCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	other := newTestCA(t, dir, "other")
+	cluster := tlsTestCluster(t, ca, "node1", "node2")
+
+	// Node 2's certificate is for the right identity, but from a CA that node 1 doesn't trust.
+	node2 := cluster.nodes[2]
+	node2.tlsCert, node2.tlsKey = other.issue("node2")
+	cluster.nodes[2] = node2
+
+	node1 := newTestTLSTransport(t, ca.file(), &cluster, 1)
+	received := listenAndRecord(t, node1, cluster.nodes[1].udpAddr)
+	untrusted := newTestTLSTransport(t, other.file(), &cluster, 2)
+	sent := listenAndRecord(t, untrusted, cluster.nodes[2].udpAddr)
+
+	if err := untrusted.Send(cluster.nodes[1].udpAddr, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	for refused := false; !refused; {
+		select {
+		case <-received.received:
+			t.Fatal("node 1 accepted a message over a certificate from another CA")
+		case err := <-received.errors:
+			refused = strings.Contains(err.Error(), "refusing connection")
+		case <-time.After(5 * time.Second):
+			t.Fatal("node 1 did not refuse the connection")
+		}
+	}
+
+	// Nor will node 1 send to it.
+	if err := node1.Send(cluster.nodes[2].udpAddr, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-sent.received:
+		t.Fatal("node 1 sent to a node with a certificate from another CA")
+	case err := <-received.errors:
+		if !strings.Contains(err.Error(), "could not send") && !strings.Contains(err.Error(), "could not connect") {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("node 1 reported nothing")
+	}
+}
+
+func TestTLSTransportNeedsACertificateForItsIdentity(t *testing.T) {
+	ca := newTestCA(t, t.TempDir(), "ca")
+	cluster := tlsTestCluster(t, ca, "node1", "node2")
+
+	cert, key := ca.issue("someone-else")
+
+	_, err := newTLSTransport(transportConfig{TransportTLS, time.Second, 8, ca.file(), cert, key}, testDirectory(&cluster), 1)
+
+	if err == nil || !strings.Contains(err.Error(), "is not for node 1") {
+		t.Fatalf("expected the certificate to be refused, got %v", err)
+	}
+}
+
+func TestTLSTransportKnowsNodesAddedToAnyJob(t *testing.T) {
+	ca := newTestCA(t, t.TempDir(), "ca")
+	two := tlsTestCluster(t, ca, "node1", "node2", "node3")
+
+	// Node 3 has since been added to job two, but not to job one.
+	one := two
+	one.nodes = map[Id]Node{1: two.nodes[1], 2: two.nodes[2]}
+
+	node1 := makeAdapter()
+	node1.nodes.update(jobId("one"), one)
+	node1.nodes.update(jobId("two"), two)
+
+	transport, err := newTLSTransport(transportConfig{TransportTLS, time.Second, 8, ca.file(), "", ""}, node1.nodes, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node1.transport = transport
+	node3 := newTestTLSTransport(t, ca.file(), &two, 3)
+	received := listenAndRecord(t, node3, two.nodes[3].udpAddr)
+
+	handled := make(chan message, 1)
+	errors := make(chan error, 16)
+
+	if err := node1.listen(two.nodes[1].udpAddr, func(m message) { handled <- m }, func(err error) { errors <- err }); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = node1.close()
+	})
+
+	if err := node3.Send(two.nodes[1].udpAddr, message{id: 3, job: jobId("two"), term: 1, mtype: MessageHeartbeat}.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-handled:
+		if m.job != jobId("two") {
+			t.Fatalf("unexpected message %s", m.String())
+		}
+	case err := <-errors:
+		t.Fatalf("node 1 refused node 3's message for job two: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("node 1 neither accepted nor refused the message")
+	}
+
+	// It is not a member of job one, though.
+	if err := node3.Send(two.nodes[1].udpAddr, message{id: 3, job: jobId("one"), term: 1, mtype: MessageHeartbeat}.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-handled:
+		t.Fatalf("node 1 accepted %s from a node not in job one", m.String())
+	case err := <-errors:
+		if !strings.Contains(err.Error(), "not in the cluster") {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("node 1 neither accepted nor refused the message")
+	}
+
+	// And node 1 can reach it.
+	if err, _ := node1.send(3, two.nodes[3].udpAddr, message{id: 1, job: jobId("two"), term: 1, mtype: MessageHeartbeat}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-received.received:
+	case err := <-errors:
+		t.Fatalf("node 1 could not send to node 3: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("node 3 received nothing")
+	}
+}
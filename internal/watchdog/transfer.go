@@ -0,0 +1,195 @@
+package watchdog
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// TransferLeadership hands leadership from this node to target, or to any
+// healthy follower if target is NullId. This is intended for planned
+// maintenance, where we want to move the process off a node without killing it.
+//
+// Our process is stopped first. Only once it has confirmed stopped is the target
+// told to start an election immediately, without waiting out its election timeout.
+// An error is returned if the transfer cannot begin, e.g. we are not the leader.
+// The remainder of the transfer happens in the background and is recorded in events.
+func (w *Watchdog) TransferLeadership(target Id) error {
+	result := make(chan error, 1)
+
+	if !w.timers.sync(func() {
+		result <- w.beginTransfer(target)
+	}) {
+		return errShutdown
+	}
+
+	return <-result
+}
+
+func (w *Watchdog) isTransferToken(token string) bool {
+	if len(w.config.transferToken) == 0 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(w.config.transferToken)) == 1
+}
+
+func (w *Watchdog) beginTransfer(target Id) error {
+	if w.state != StateLeading {
+		return fmt.Errorf("Cannot transfer leadership: this node is %s\n", w.state.String())
+	}
+
+	if !w.transferTarget.IsNull() {
+		return fmt.Errorf("Leadership is already being transferred to %d\n", w.transferTarget)
+	}
+
+	if target.IsNull() {
+		target = w.healthiestFollower()
+
+		if target.IsNull() {
+			return fmt.Errorf("Cannot transfer leadership: no healthy follower to transfer to\n")
+		}
+	} else if target == w.id {
+		return fmt.Errorf("Cannot transfer leadership to ourselves\n")
+	} else if _, err := w.cluster.AddressFor(target); err != nil {
+		return err
+	} else if !w.cluster.RoleOf(target).canLead() {
+		return fmt.Errorf("Cannot transfer leadership to %d: it is a %s\n", target, w.cluster.RoleOf(target))
+	}
+
+	w.event(fmt.Sprintf("transferring leadership to %d", target))
+
+	// Stop our process and make sure it does not start again.
+	w.transferTarget = target
+	w.canRunProcess = false
+
+	term := w.currentTerm
+	// Allow for the process using all of its grace period, and our post-stop hooks.
+	deadline := w.clock.Now().Add(w.config.command.stop.gracePeriod + w.config.command.hooks.maxPostStop() + w.config.networkInterval)
+
+	w.routines.Add(1)
+
+	go func() {
+		defer w.routines.Done()
+
+		for w.isLeadingActive() && w.clock.Now().Before(deadline) {
+			time.Sleep(processCheckInterval)
+		}
+
+		w.timers.sync(func() {
+			w.completeTransfer(target, term)
+		})
+	}()
+
+	return nil
+}
+
+func (w *Watchdog) completeTransfer(target Id, term uint64) {
+	if w.state != StateLeading || w.currentTerm != term || w.transferTarget != target {
+		// We lost leadership whilst waiting; nothing left to hand over.
+		return
+	}
+
+	if w.isLeadingActive() {
+		w.event(fmt.Sprintf("aborted leadership transfer to %d: did not stop working as leader", target))
+		w.transferTarget = NullId
+		w.canRunProcess = true
+		return
+	}
+
+	// Everyone following us should stop doing so, so that they
+	// are free to vote. The target will start an election right away.
+	m := w.message(MessageTimeoutNow)
+	m.leader = target
+
+	if w.graceElapsed {
+		// Our work confirmed stopped in this term, after any earlier leader's, so
+		// the target need not wait out its leadership grace if it wins the next.
+		m.payload = make([]byte, 8)
+		binary.BigEndian.PutUint64(m.payload, term)
+	}
+
+	w.broadcast(m)
+	w.event(fmt.Sprintf("handed leadership to %d", target))
+	w.transition(StateIdle)
+}
+
+// The payload, if any, is the term in which the leader's work confirmed stopped.
+func (w *Watchdog) handleTimeoutNow(id Id, target Id, payload []byte) {
+	if w.state != StateFollowing || w.leader != id {
+		// Only our current leader can hand over its leadership.
+		return
+	}
+
+	// It's no longer a candidate for leadership itself, whatever its priority.
+	delete(w.lastSeen, id)
+
+	if target == w.id && w.clock.Now().Before(w.candidacyPausedUntil) {
+		// We gave up leadership recently; let the others elect someone else as normal.
+		w.event(fmt.Sprintf("declined leadership from %d", id))
+		w.transition(StateIdle)
+	} else if target == w.id {
+		w.event(fmt.Sprintf("leadership handed over by %d", id))
+		stopped := len(payload) == 8 && binary.BigEndian.Uint64(payload) == w.currentTerm
+		w.startElection(id)
+
+		if stopped && w.state == StateElection {
+			w.handedOverTerm = w.currentTerm
+		}
+	} else {
+		w.transition(StateIdle)
+	}
+}
+
+// Tells our followers that we are going away, as we shut down, so they need not wait out their
+// LeadershipAwareTimeout. Our work as leader must already have stopped. The follower we heard
+// from most recently is named as our successor, and stands for election straight away.
+func (w *Watchdog) resign() {
+	if w.state != StateLeading {
+		return
+	}
+
+	m := w.message(MessageResign)
+	m.leader = w.healthiestFollower()
+
+	w.event(fmt.Sprintf("resigning, suggesting %d", m.leader))
+	w.broadcast(m)
+	w.transition(StateIdle)
+}
+
+func (w *Watchdog) handleResign(id Id, successor Id) {
+	if w.state != StateFollowing || w.leader != id {
+		// Only our current leader can resign.
+		return
+	}
+
+	w.event(fmt.Sprintf("leader %d resigned", id))
+	delete(w.lastSeen, id)
+	w.transition(StateIdle)
+
+	if w.cluster.RoleOf(w.id).canLead() && (successor == w.id || successor.IsNull()) {
+		// If no successor was named, everyone stands; the pre-vote still applies.
+		w.onElectionTimeout()
+	}
+}
+
+// The follower we heard from most recently, or NullId if
+// none have been heard from within the network interval.
+func (w *Watchdog) healthiestFollower() Id {
+	best := NullId
+	var bestSeen time.Time
+
+	for id, seen := range w.followerSeen {
+		if id == w.id || !w.cluster.RoleOf(id).canLead() || w.clock.Now().Sub(seen) > w.config.networkInterval {
+			continue
+		}
+
+		// Ties go to the lowest id, so that the choice doesn't depend on map order.
+		if best.IsNull() || seen.After(bestSeen) || (seen.Equal(bestSeen) && id < best) {
+			best, bestSeen = id, seen
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,139 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+)
+
+// The simulated demo's timings, with a leadership grace of 22s.
+const simulationTestConfig = `
+minElectionTimeout: 3000
+maxElectionTimeout: 5000
+networkInterval: 10000
+heartbeatInterval: 1000
+listenOn: "127.0.0.1:6000"
+`
+
+func newTestSimulation(t *testing.T, seed int64, cluster string) *Simulation {
+	config, err := ParseEmbeddedConfiguration([]byte(simulationTestConfig))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseCluster([]byte(cluster))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSimulation(SimulationConfig{
+		Seed:          seed,
+		Configuration: config,
+		Cluster:       parsed,
+		Network:       NetworkConditions{MinDelay: time.Millisecond, MaxDelay: 20 * time.Millisecond},
+	})
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(s.Shutdown)
+
+	return s
+}
+
+func simulatedNode(s *Simulation, id Id) SimulatedNode {
+	for _, node := range s.Nodes() {
+		if node.Id == id {
+			return node
+		}
+	}
+
+	return SimulatedNode{}
+}
+
+// Runs the simulation, in steps of virtual time, until done reports true. Leadership
+// transfers wait in real time for the leader's work to stop, so this gives them time to.
+func runUntil(t *testing.T, s *Simulation, description string, done func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s, after %s:\n%v", description, s.Elapsed(), s.Nodes())
+		}
+
+		if err := s.RunFor(100 * time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTransferLeadershipFromAPreferredNode(t *testing.T) {
+	s := newTestSimulation(t, 1, `
+nodes:
+  - {id: 1, udpAddr: "node1:6000", httpAddr: "http://node1", priority: 10}
+  - {id: 2, udpAddr: "node2:6000", httpAddr: "http://node2"}
+  - {id: 3, udpAddr: "node3:6000", httpAddr: "http://node3"}
+`)
+
+	runUntil(t, s, "node 1 to lead", func() bool {
+		return simulatedNode(s, 1).Active
+	})
+
+	term := simulatedNode(s, 1).Term
+
+	if err := s.nodes[1].TransferLeadership(2); err != nil {
+		t.Fatal(err)
+	}
+
+	runUntil(t, s, "node 2 to be elected", func() bool {
+		return simulatedNode(s, 2).State == StateLeading
+	})
+
+	elected := s.Elapsed()
+
+	runUntil(t, s, "node 2 to lead", func() bool {
+		return simulatedNode(s, 2).Active
+	})
+
+	// Node 1's work confirmed stopped, so node 2 waits out only the clock drift (1s), not the 22s grace.
+	if waited := s.Elapsed() - elected; waited > time.Second+100*time.Millisecond {
+		t.Errorf("node 2 waited %s after its election to start working", waited)
+	}
+
+	if err := s.RunFor(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range s.Nodes() {
+		if node.Leader != 2 || node.Term != term+1 {
+			t.Errorf("node %d should follow node 2 in term %d, got leader %d in term %d", node.Id, term+1, node.Leader, node.Term)
+		}
+	}
+}
+
+func TestPreferredNodeCanStepDown(t *testing.T) {
+	s := newTestSimulation(t, 2, `
+nodes:
+  - {id: 1, udpAddr: "node1:6000", httpAddr: "http://node1", priority: 10}
+  - {id: 2, udpAddr: "node2:6000", httpAddr: "http://node2"}
+  - {id: 3, udpAddr: "node3:6000", httpAddr: "http://node3"}
+`)
+
+	runUntil(t, s, "node 1 to lead", func() bool {
+		return simulatedNode(s, 1).Active
+	})
+
+	// As if its process crash-looped.
+	s.nodes[1].timers.sync(func() {
+		s.nodes[1].stepDown("testing")
+	})
+
+	runUntil(t, s, "another node to lead", func() bool {
+		leader := simulatedNode(s, 2).Leader
+		return (leader == 2 || leader == 3) && simulatedNode(s, leader).Active
+	})
+}
@@ -0,0 +1,85 @@
+package watchdog
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// A Transport carries serialized messages between watchdog nodes, addressed by
+// each node's address in the Cluster. It need not be reliable: the election
+// copes with messages that are lost, delayed or duplicated.
+type Transport interface {
+	// Starts receiving messages on addr in the background, passing each to
+	// handler with the address it came from, and any failure to errorhandler.
+	Listen(addr string, handler func(data []byte, from net.Addr), errorhandler func(error)) error
+	// Sends data to addr. This may return before data is delivered, or even
+	// sent, in which case any later failure goes to Listen's errorhandler.
+	Send(addr string, data []byte) error
+	// Stops listening and sending. Once this returns, handler is not called again.
+	Close() error
+}
+
+// A Transport may also promise that Send never blocks, e.g. as it only queues the message.
+// Messages are then sent straight from the election's queue, rather than each on a goroutine.
+type nonBlockingTransport interface {
+	nonBlocking()
+}
+
+// A Transport may also vouch for who sent a message, e.g. by the certificate they presented.
+// The address it passes to Listen's handler then checks the identity the message's node should have.
+type identifiedAddr interface {
+	verifyIdentity(identity string) error
+}
+
+type transportType string
+
+const (
+	// A datagram per message, from a new socket each time.
+	TransportUDP transportType = "udp"
+	// A persistent connection to each node, reconnecting as needed.
+	TransportTCP transportType = "tcp"
+	// As tcp, but encrypted with TLS, with each node proving its identity by a certificate from our CA.
+	TransportTLS transportType = "tls"
+)
+
+type transportConfig struct {
+	transport transportType
+	// How long a TCP connection attempt may take.
+	dialTimeout time.Duration
+	// How many messages may wait to be sent to each node over TCP, beyond which they are dropped.
+	queueLength int
+	// With TLS, the CA that signs every node's certificate, and our certificate & key,
+	// in place of those in the cluster file.
+	ca   string
+	cert string
+	key  string
+}
+
+// Checks that addr is something the configured transport can listen on.
+func (c transportConfig) resolve(addr string) error {
+	var err error
+
+	switch c.transport {
+	case TransportTCP, TransportTLS:
+		_, err = net.ResolveTCPAddr("tcp", addr)
+	default:
+		_, err = net.ResolveUDPAddr("udp", addr)
+	}
+
+	return err
+}
+
+// Makes the configured transport for node self. TLS needs the nodes to know each one's identity.
+func newTransport(config transportConfig, nodes *directory, self Id) (Transport, error) {
+	switch config.transport {
+	case TransportUDP:
+		return newUDPTransport(), nil
+	case TransportTCP:
+		return newTCPTransport(config.dialTimeout, config.queueLength), nil
+	case TransportTLS:
+		return newTLSTransport(config, nodes, self)
+	}
+
+	return nil, fmt.Errorf("Unknown transport %q\n", config.transport)
+}
@@ -0,0 +1,87 @@
+package watchdog
+
+import (
+	"errors"
+	"net"
+)
+
+// Sends each message as a single datagram. Nothing is retried, and nodes
+// are not told who sent what: every message says which node it's from.
+type udpTransport struct {
+	// The socket we're listening on, if any, and closed once we've stopped.
+	conn     *net.UDPConn
+	listened chan struct{}
+}
+
+func newUDPTransport() *udpTransport {
+	return new(udpTransport)
+}
+
+func (t *udpTransport) Listen(addr string, handler func([]byte, net.Addr), errorhandler func(error)) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.ListenUDP("udp", udpAddr)
+
+	if err != nil {
+		return err
+	}
+
+	t.conn = listener
+	t.listened = make(chan struct{})
+
+	go func() {
+		defer close(t.listened)
+
+		// One byte larger than any valid message, so oversized
+		// messages are rejected rather than silently truncated.
+		buffer := make([]byte, maxMessageLength+1)
+
+		for {
+			if n, from, err := listener.ReadFrom(buffer); errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				errorhandler(err)
+			} else {
+				// Copy out, as the message may outlive this buffer.
+				handler(append([]byte(nil), buffer[:n]...), from)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (t *udpTransport) Send(addr string, data []byte) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write(data)
+
+	return err
+}
+
+func (t *udpTransport) Close() error {
+	if t.conn == nil {
+		return nil
+	}
+
+	err := t.conn.Close()
+	<-t.listened
+
+	return err
+}
@@ -2,11 +2,15 @@ package watchdog
 
 type votes map[Id]bool
 
+// Creates an empty set of votes from the nodes that count towards
+// a majority. Votes from any other node (e.g. observers) are ignored.
 func createVotes(cluster Cluster) votes {
 	v := make(votes)
 
-	for node := range cluster.nodes {
-		v[node] = false
+	for id, node := range cluster.nodes {
+		if node.role.votes() {
+			v[id] = false
+		}
 	}
 
 	return v
@@ -0,0 +1,165 @@
+// Package election elects a single leader from a cluster of nodes, for Go services
+// that embed the election rather than running the watchdog binary around a command.
+// Nodes are configured with the same YAML files as the watchdog binary, but the
+// command is optional: the leader's work is done by callbacks instead.
+//
+//	config, err := election.ParseConfiguration(configYaml)
+//	cluster, err := election.ParseCluster(clusterYaml)
+//
+//	elector := election.New(election.Config{
+//		Id:            1,
+//		Configuration: config,
+//		Cluster:       cluster,
+//		Callbacks: election.LeaderCallbacks{
+//			OnStartedLeading: func(ctx context.Context) {
+//				// Work as leader until ctx is done.
+//			},
+//			OnStoppedLeading: func() {},
+//			OnNewLeader:      func(id election.Id) {},
+//		}.Callbacks(),
+//	})
+//
+//	err = elector.Start(ctx)
+//
+// Once ctx is done, OnStartedLeading must return within the command's stop.gracePeriod
+// (10s by default), as the election's timing allows for that before another node may lead.
+package election
+
+import (
+	"context"
+	"single-executor/internal/watchdog"
+)
+
+type (
+	// A node in the cluster.
+	Id = watchdog.Id
+	// Identifies a leadership. See FencingTokenFrom.
+	FencingToken  = watchdog.FencingToken
+	Configuration = watchdog.Configuration
+	Cluster       = watchdog.Cluster
+	// What the leader does, and how everyone else hears about it.
+	Callbacks = watchdog.Callbacks
+)
+
+// No node, e.g. when there's no leader.
+const NullId = watchdog.NullId
+
+// Parses a watchdog configuration file. A command is not required.
+func ParseConfiguration(in []byte) (Configuration, error) {
+	return watchdog.ParseEmbeddedConfiguration(in)
+}
+
+// Parses a watchdog cluster file.
+func ParseCluster(in []byte) (Cluster, error) {
+	return watchdog.ParseCluster(in)
+}
+
+// The fencing token of the leadership that ctx, as given to OnStartedLeading, belongs to.
+// Pass this on with anything done as leader, so stale leaders can be told apart.
+func FencingTokenFrom(ctx context.Context) (FencingToken, bool) {
+	return watchdog.FencingTokenFrom(ctx)
+}
+
+type Config struct {
+	// This node, which must be in the Cluster.
+	Id            Id
+	Configuration Configuration
+	Cluster       Cluster
+	// If nil, the configured command is run whilst leading, as by the watchdog binary.
+	Callbacks Callbacks
+	// Called with anything that goes wrong (e.g. network errors), which are otherwise discarded.
+	OnError func(err error)
+}
+
+// Callbacks as funcs, any of which may be nil.
+type LeaderCallbacks struct {
+	// Called when this node starts leading. ctx is cancelled when it stops.
+	OnStartedLeading func(ctx context.Context)
+	// Called once OnStartedLeading has returned after leadership was lost.
+	OnStoppedLeading func()
+	// Called when a different leader (possibly this node) is seen.
+	OnNewLeader func(id Id)
+}
+
+func (l LeaderCallbacks) Callbacks() Callbacks {
+	return callbackFuncs{l}
+}
+
+type callbackFuncs struct {
+	funcs LeaderCallbacks
+}
+
+func (c callbackFuncs) OnStartedLeading(ctx context.Context) {
+	if c.funcs.OnStartedLeading != nil {
+		c.funcs.OnStartedLeading(ctx)
+	}
+}
+
+func (c callbackFuncs) OnStoppedLeading() {
+	if c.funcs.OnStoppedLeading != nil {
+		c.funcs.OnStoppedLeading()
+	}
+}
+
+func (c callbackFuncs) OnNewLeader(id Id) {
+	if c.funcs.OnNewLeader != nil {
+		c.funcs.OnNewLeader(id)
+	}
+}
+
+// Takes part in the election for a single node.
+type Elector struct {
+	w       *watchdog.Watchdog
+	onError func(err error)
+}
+
+func New(config Config) *Elector {
+	return &Elector{
+		watchdog.NewWatchdogWithCallbacks(config.Id, config.Configuration, config.Cluster, config.Callbacks),
+		config.OnError,
+	}
+}
+
+// Starts taking part in the election, in the background, until ctx is done or Shutdown is called.
+func (e *Elector) Start(ctx context.Context) error {
+	if err := e.w.Start(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case err := <-e.w.Errors:
+				if e.onError != nil {
+					e.onError(err)
+				}
+			case <-e.w.Info:
+			case <-e.w.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stops taking part in the election, once any work as leader has stopped (i.e.
+// OnStartedLeading has returned). Returns ctx's error if ctx is done first.
+func (e *Elector) Shutdown(ctx context.Context) error {
+	return e.w.Shutdown(ctx)
+}
+
+// Closed once shut down.
+func (e *Elector) Done() <-chan struct{} {
+	return e.w.Done()
+}
+
+// The current leader, as far as this node knows, or NullId if there is none. Must be started.
+func (e *Elector) Leader() Id {
+	return e.w.Leader()
+}
+
+// Hands leadership to target, or any healthy node if NullId. Must be called on the leader.
+func (e *Elector) TransferLeadership(target Id) error {
+	return e.w.TransferLeadership(target)
+}
@@ -23,6 +23,7 @@ export interface NodeData {
   id: number
   events: EventData[]
   state: string
+  subState: string
   blacklist: number[]
 }
 